@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Chunked Transfer Coding (RFC 9112 section 7.1)
+
+// chunkedBodyReader decodes a chunked message body read from the connection.
+// Chunk extensions are ignored and trailer fields are stored in trailers once
+// the last chunk has been read. The trailer section gets the same limits as
+// the header section.
+type chunkedBodyReader struct {
+	reader    *bufio.Reader
+	trailers  Http_Header
+	remaining int64 // bytes left in the current chunk
+	done      bool
+	// Framing is lost after an error, every later Read returns it again
+	err error
+}
+
+func newChunkedBodyReader(reader *bufio.Reader, trailers Http_Header) *chunkedBodyReader {
+	return &chunkedBodyReader{reader: reader, trailers: trailers}
+}
+
+func malformedChunk(msg string) error {
+	return newHttpError(400, "Malformed chunked body: "+msg)
+}
+
+func (c *chunkedBodyReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.read(p)
+	if err != nil && err != io.EOF {
+		c.err = err
+	}
+	return n, err
+}
+
+func (c *chunkedBodyReader) read(p []byte) (int, error) {
+	if c.done {
+		return 0, io.EOF
+	}
+	if c.remaining == 0 {
+		size, err := c.readChunkSize()
+		if err != nil {
+			return 0, err
+		}
+		if size == 0 {
+			debug("Last chunk found, reading trailers...")
+			if err := c.readTrailers(); err != nil {
+				return 0, err
+			}
+			c.done = true
+			return 0, io.EOF
+		}
+		c.remaining = size
+	}
+
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.reader.Read(p)
+	c.remaining -= int64(n)
+	if err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return n, err
+	}
+	if c.remaining == 0 {
+		// Every chunk's data is followed by CRLF
+		if err := c.readChunkEnd(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// readLine reads one line of framing, up to limit bytes long
+func (c *chunkedBodyReader) readLine(limit int) (string, error) {
+	line, err := readLimitedLine(c.reader, limit)
+	if err == io.EOF {
+		return "", io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", err
+	}
+	if STRICT_PARSING {
+		// Bare LF line endings are refused, as in the header section
+		return trimLineEnding(line)
+	}
+	return strings.TrimRight(line, CRLF), nil
+}
+
+func isHexDigits(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	return strings.Trim(s, "0123456789abcdefABCDEF") == ""
+}
+
+func (c *chunkedBodyReader) readChunkSize() (int64, error) {
+	line, err := c.readLine(MAX_HEADER_BYTES)
+	if err == errLineTooLong {
+		return 0, malformedChunk("chunk size line too long")
+	}
+	if err != nil {
+		return 0, err
+	}
+	// chunk-size [ ; chunk-ext ]
+	sizeField, extensions, hasExtensions := strings.Cut(line, ";")
+	if hasExtensions {
+		debugf("Ignoring chunk extensions: %s", extensions)
+	}
+	if hasExtensions {
+		// chunk-ext = *( BWS ";" BWS chunk-ext-name ... ), whitespace may end the size
+		sizeField = strings.TrimRight(sizeField, " \t")
+	}
+	if STRICT_PARSING && !isHexDigits(sizeField) {
+		// No other whitespace, sign or prefix, chunk-size is 1*HEXDIG
+		return 0, malformedChunk("invalid chunk size " + strconv.Quote(sizeField))
+	}
+	sizeField = strings.TrimSpace(sizeField)
+	if len(sizeField) == 0 {
+		return 0, malformedChunk("missing chunk size")
+	}
+	size, err := strconv.ParseInt(sizeField, 16, 64)
+	if err != nil || size < 0 {
+		return 0, malformedChunk("invalid chunk size " + strconv.Quote(sizeField))
+	}
+	debugf("Next chunk size: %d", size)
+	return size, nil
+}
+
+func (c *chunkedBodyReader) readChunkEnd() error {
+	line, err := c.readLine(MAX_HEADER_BYTES)
+	if err == errLineTooLong {
+		return malformedChunk("chunk data longer than chunk size")
+	}
+	if err != nil {
+		return err
+	}
+	if len(line) != 0 {
+		return malformedChunk("chunk data longer than chunk size")
+	}
+	return nil
+}
+
+func (c *chunkedBodyReader) readTrailers() error {
+	fieldCount := 0
+	trailerBytes := 0
+	for {
+		line, err := c.readLine(MAX_HEADER_BYTES - trailerBytes)
+		if err == errLineTooLong {
+			return newHttpError(431, "Request trailers exceed the size limit.")
+		}
+		if err != nil {
+			return err
+		}
+		if len(line) == 0 {
+			return nil // end of trailer section
+		}
+		trailerBytes += len(line) + len(CRLF)
+		fieldCount++
+		if fieldCount > MAX_HEADER_COUNT {
+			return newHttpError(431, "Too many request trailers.")
+		}
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			return malformedChunk("invalid trailer field " + strconv.Quote(line))
+		}
+		debugf("Trailer field: %s", key)
+		if c.trailers != nil {
+			c.trailers.Add(key, strings.TrimSpace(value))
+		}
+	}
+}
+
+// chunkedBodyWriter encodes everything written to it as one chunk per Write.
+// Chunks are flushed straight away when the underlying writer buffers, so
+// generated bodies reach the client as they are produced.
+type chunkedBodyWriter struct {
+	writer io.Writer
+}
+
+func newChunkedBodyWriter(writer io.Writer) *chunkedBodyWriter {
+	return &chunkedBodyWriter{writer: writer}
+}
+
+func (c *chunkedBodyWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		// A zero length chunk would end the body
+		return 0, nil
+	}
+	if _, err := io.WriteString(c.writer, strconv.FormatInt(int64(len(p)), 16)+CRLF); err != nil {
+		return 0, err
+	}
+	n, err := c.writer.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if _, err := io.WriteString(c.writer, CRLF); err != nil {
+		return n, err
+	}
+	if flusher, ok := c.writer.(interface{ Flush() error }); ok {
+		return n, flusher.Flush()
+	}
+	return n, nil
+}
+
+// finish writes the last chunk followed by the trailer section
+func (c *chunkedBodyWriter) finish(trailers Http_Header) error {
+	lastChunk := "0" + CRLF
+	if len(trailers) > 0 {
+		lastChunk += headersMapToString(trailers)
+	}
+	lastChunk += CRLF
+	_, err := io.WriteString(c.writer, lastChunk)
+	return err
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestChunkedBodyReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		strict  bool
+		encoded string
+		body    string
+		status  int
+	}{
+		{"single chunk", true, "3\r\nabc\r\n0\r\n\r\n", "abc", 0},
+		{"several chunks", true, "3\r\nabc\r\na\r\n0123456789\r\n0\r\n\r\n", "abc0123456789", 0},
+		{"uppercase hex", true, "A\r\n0123456789\r\n0\r\n\r\n", "0123456789", 0},
+		{"extension", true, "3;ext\r\nabc\r\n0\r\n\r\n", "abc", 0},
+		{"extension with value", true, "3;name=\"value\"\r\nabc\r\n0;last\r\n\r\n", "abc", 0},
+		{"trailer", true, "3\r\nabc\r\n0\r\nX-Sum: 1\r\n\r\n", "abc", 0},
+		{"sign", true, "+3\r\nabc\r\n0\r\n\r\n", "", 400},
+		{"bare LF after size", true, "3\nabc\r\n0\r\n\r\n", "", 400},
+		{"bare LF after data", true, "3\r\nabc\n0\r\n\r\n", "abc", 400},
+		{"leading space", true, " 3\r\nabc\r\n0\r\n\r\n", "", 400},
+		{"trailing space", true, "3 \r\nabc\r\n0\r\n\r\n", "", 400},
+		{"space before extension", true, "3 ;ext\r\nabc\r\n0\r\n\r\n", "abc", 0},
+		{"whitespace around extension", true, "3\t ; ext\r\nabc\r\n0 ;last\r\n\r\n", "abc", 0},
+		{"space before size with extension", true, " 3;ext\r\nabc\r\n0\r\n\r\n", "", 400},
+		{"hex prefix with extension", true, "0x3 ;ext\r\nabc\r\n0\r\n\r\n", "", 400},
+		{"hex prefix", true, "0x3\r\nabc\r\n0\r\n\r\n", "", 400},
+		{"missing size", true, "\r\nabc\r\n0\r\n\r\n", "", 400},
+		{"data longer than size", true, "3\r\nabcd\r\n0\r\n\r\n", "abc", 400},
+		{"trailer without colon", true, "3\r\nabc\r\n0\r\nX-Sum\r\n\r\n", "abc", 400},
+		{"truncated", true, "3\r\nab", "ab", -1},
+		// The lenient mode accepts what it can still read one way
+		{"lenient bare LF", false, "3\nabc\n0\n\n", "abc", 0},
+		{"lenient spaces", false, " 3 \r\nabc\r\n0\r\n\r\n", "abc", 0},
+		{"lenient sign", false, "-3\r\nabc\r\n0\r\n\r\n", "", 400},
+		{"lenient hex prefix", false, "0x3\r\nabc\r\n0\r\n\r\n", "", 400},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setStrict(t, test.strict)
+			trailers := make(Http_Header)
+			reader := newChunkedBodyReader(bufio.NewReader(strings.NewReader(test.encoded)), trailers)
+			body, err := io.ReadAll(reader)
+			if string(body) != test.body {
+				t.Errorf("body = %q, want %q", body, test.body)
+			}
+			if status := errorStatus(err); status != test.status {
+				t.Errorf("status = %d, want %d (error: %v)", status, test.status, err)
+			}
+			if err != nil {
+				// Framing is lost after an error, reading on must not find more chunks
+				if _, again := reader.Read(make([]byte, 8)); again != err {
+					t.Errorf("Read after error = %v, want %v", again, err)
+				}
+			}
+		})
+	}
+}
+
+func TestChunkedBodyTrailers(t *testing.T) {
+	trailers := make(Http_Header)
+	encoded := "3\r\nabc\r\n0\r\nX-Sum: 1 \r\nX-Other:2\r\n\r\nGET / HTTP/1.1\r\n"
+	reader := bufio.NewReader(strings.NewReader(encoded))
+	if _, err := io.ReadAll(newChunkedBodyReader(reader, trailers)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sum := trailers.Get("X-Sum"); sum != "1" {
+		t.Errorf("X-Sum = %q, want %q", sum, "1")
+	}
+	if other := trailers.Get("X-Other"); other != "2" {
+		t.Errorf("X-Other = %q, want %q", other, "2")
+	}
+	// The next request on the connection is left untouched
+	if rest, _ := io.ReadAll(reader); string(rest) != "GET / HTTP/1.1\r\n" {
+		t.Errorf("left on the connection: %q", rest)
+	}
+}
+
+func TestChunkedBodyTrailerLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		trailers string
+		status   int
+	}{
+		{"most trailer fields", strings.Repeat("X-A: 1\r\n", MAX_HEADER_COUNT), 0},
+		{"too many trailer fields", strings.Repeat("X-A: 1\r\n", MAX_HEADER_COUNT+1), 431},
+		{"trailer line too long", "X-A: " + strings.Repeat("a", MAX_HEADER_BYTES) + "\r\n", 431},
+		{"trailer section too large", strings.Repeat("X-A: "+strings.Repeat("a", 1000)+"\r\n", MAX_HEADER_BYTES/1000+1), 431},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoded := "3\r\nabc\r\n0\r\n" + test.trailers + "\r\n"
+			reader := newChunkedBodyReader(bufio.NewReader(strings.NewReader(encoded)), make(Http_Header))
+			_, err := io.ReadAll(reader)
+			if status := errorStatus(err); status != test.status {
+				t.Errorf("status = %d, want %d (error: %v)", status, test.status, err)
+			}
+		})
+	}
+}
+
+func TestChunkedBodyWriter(t *testing.T) {
+	var encoded strings.Builder
+	writer := newChunkedBodyWriter(&encoded)
+	for _, part := range []string{"abc", "", "0123456789"} {
+		if _, err := io.WriteString(writer, part); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	trailers := make(Http_Header)
+	trailers.Set("X-Sum", "1")
+	if err := writer.finish(trailers); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "3\r\nabc\r\na\r\n0123456789\r\n0\r\nX-Sum: 1\r\n\r\n"
+	if encoded.String() != want {
+		t.Errorf("encoded = %q, want %q", encoded.String(), want)
+	}
+}
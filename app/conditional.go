@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Conditional Requests (RFC 9110 section 13)
+
+// ETAG_MODE is "strong" or "weak", set by the --etag flag
+var ETAG_MODE = "strong"
+
+// fileETag derives an entity tag from the modification time and size of a file
+func fileETag(fileInfo os.FileInfo) string {
+	etag := fmt.Sprintf("\"%x-%x\"", fileInfo.ModTime().UnixNano(), fileInfo.Size())
+	if ETAG_MODE == "weak" {
+		return "W/" + etag
+	}
+	return etag
+}
+
+func lastModified(fileInfo os.FileInfo) time.Time {
+	// HTTP dates have one second resolution
+	return fileInfo.ModTime().UTC().Truncate(time.Second)
+}
+
+// setValidators adds the ETag and Last-Modified headers of a file to res
+func setValidators(res *Http_Response, fileInfo os.FileInfo) {
+	res.Headers.Set("ETag", fileETag(fileInfo))
+	res.Headers.Set("Last-Modified", lastModified(fileInfo).Format(HTTP_TIME_FORMAT))
+}
+
+// parseETagList splits an If-Match or If-None-Match value into its entity tags
+func parseETagList(value string) []string {
+	var etags []string
+	value = strings.TrimSpace(value)
+	for len(value) > 0 {
+		value = strings.TrimLeft(value, ", \t")
+		if len(value) == 0 {
+			break
+		}
+		if value[0] == '*' {
+			etags = append(etags, "*")
+			value = value[1:]
+			continue
+		}
+		prefix := ""
+		if strings.HasPrefix(value, "W/") {
+			prefix = "W/"
+			value = value[2:]
+		}
+		if len(value) == 0 || value[0] != '"' {
+			debugf("Malformed entity tag list at: %s", value)
+			break
+		}
+		end := strings.IndexByte(value[1:], '"')
+		if end == -1 {
+			debugf("Unterminated entity tag: %s", value)
+			break
+		}
+		etags = append(etags, prefix+value[:end+2])
+		value = value[end+2:]
+	}
+	return etags
+}
+
+// etagList joins every line of an entity tag list header into one list
+func etagList(req Http_Request, key string) string {
+	return strings.Join(req.Headers.Values(key), ", ")
+}
+
+// etagMatches compares etag to every tag in list, weakly or strongly
+func etagMatches(list string, etag string, weak bool) bool {
+	for _, candidate := range parseETagList(list) {
+		if candidate == "*" {
+			return true
+		}
+		if weak {
+			if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		} else if candidate == etag && !strings.HasPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified evaluates If-None-Match and If-Modified-Since for a GET of the file
+func notModified(req Http_Request, fileInfo os.FileInfo) bool {
+	if req.Headers.Has("If-None-Match") {
+		// If-Modified-Since is ignored when If-None-Match is present
+		return etagMatches(etagList(req, "If-None-Match"), fileETag(fileInfo), true)
+	}
+	if req.Headers.Has("If-Modified-Since") {
+		ifModifiedSince := req.Headers.Get("If-Modified-Since")
+		date, err := parseHTTPDate(ifModifiedSince)
+		if err != nil {
+			debugf("Ignoring invalid If-Modified-Since: %s", ifModifiedSince)
+			return false
+		}
+		return !lastModified(fileInfo).After(date)
+	}
+	return false
+}
+
+// uploadPreconditionFailed evaluates If-Match, If-Unmodified-Since and
+// If-None-Match against the file an upload would replace
+func uploadPreconditionFailed(req Http_Request, filePath string) bool {
+	fileInfo, err := os.Stat(filePath)
+	exists := err == nil
+
+	if req.Headers.Has("If-Match") {
+		ifMatch := etagList(req, "If-Match")
+		if !exists || !etagMatches(ifMatch, fileETag(fileInfo), false) {
+			debugf("If-Match failed: %s", ifMatch)
+			return true
+		}
+	} else if req.Headers.Has("If-Unmodified-Since") && exists {
+		ifUnmodifiedSince := req.Headers.Get("If-Unmodified-Since")
+		date, err := parseHTTPDate(ifUnmodifiedSince)
+		if err == nil && lastModified(fileInfo).After(date) {
+			debugf("If-Unmodified-Since failed: %s", ifUnmodifiedSince)
+			return true
+		}
+	}
+
+	if req.Headers.Has("If-None-Match") && exists {
+		ifNoneMatch := etagList(req, "If-None-Match")
+		if etagMatches(ifNoneMatch, fileETag(fileInfo), true) {
+			debugf("If-None-Match failed: %s", ifNoneMatch)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Listener Handoff
+// Listening sockets can be inherited from systemd socket activation or from a
+// previous server process, so the binary can be replaced without refusing
+// connections.
+
+// First inherited file descriptor, after stdin, stdout and stderr
+const LISTEN_FDS_START = 3
+
+// LISTEN_FDNAMES name of listeners that redirect to HTTPS, any other name is
+// a regular listener
+const REDIRECT_FD_NAME = "redirect"
+
+// Environment variable with the descriptor a new process reports on once it
+// serves its listeners, see notifyReady
+const READY_FD_ENV = "READY_FD"
+
+// How long a new process gets to start serving before the handoff is given up
+const READY_TIMEOUT = 15 * time.Second
+
+// Set when unix socket files were created by this server, so they are removed
+// on shutdown. Sockets from systemd belong to the socket unit.
+var ownsSocketFiles = true
+
+// inheritedListeners returns the regular and redirect listeners passed in
+// through LISTEN_FDS. When LISTEN_PID is set they must be meant for this
+// process, a re-exec by the server itself can't know the pid of its child and
+// leaves it unset.
+func inheritedListeners() ([]net.Listener, []net.Listener) {
+	fdCount := os.Getenv("LISTEN_FDS")
+	if len(fdCount) == 0 {
+		return nil, nil
+	}
+	// Children of this process must not inherit them again
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+	defer os.Unsetenv("LISTEN_UNLINK")
+
+	listenPid := os.Getenv("LISTEN_PID")
+	if len(listenPid) > 0 && listenPid != strconv.Itoa(os.Getpid()) {
+		debugf("Ignoring LISTEN_FDS meant for pid %s", listenPid)
+		return nil, nil
+	}
+	// A previous server process passes on whether it created the socket files
+	ownsSocketFiles = os.Getenv("LISTEN_UNLINK") == "1"
+	count, err := strconv.Atoi(fdCount)
+	if err != nil || count < 0 {
+		handleError("Invalid LISTEN_FDS", fmt.Errorf("Expected a count, received: %s", fdCount))
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	var listeners, redirectListeners []net.Listener
+	for i := 0; i < count; i++ {
+		name := fmt.Sprintf("fd %d", LISTEN_FDS_START+i)
+		if i < len(names) && len(names[i]) > 0 {
+			name = names[i]
+		}
+		file := os.NewFile(uintptr(LISTEN_FDS_START+i), name)
+		listener, err := net.FileListener(file)
+		// The listener holds its own copy of the descriptor
+		file.Close()
+		if err != nil {
+			handleError(fmt.Sprintf("Inherited %s is not a listening socket", name), err)
+		}
+		if unixListener, ok := listener.(*net.UnixListener); ok {
+			unixListener.SetUnlinkOnClose(ownsSocketFiles)
+		}
+		fmt.Printf("Listening on inherited %s:%s (%s)\n", listener.Addr().Network(), listener.Addr(), name)
+		if name == REDIRECT_FD_NAME {
+			redirectListeners = append(redirectListeners, listener)
+		} else {
+			listeners = append(listeners, listener)
+		}
+	}
+	return listeners, redirectListeners
+}
+
+// listenerFile returns a duplicate of the descriptor behind listener
+func listenerFile(listener net.Listener) (*os.File, error) {
+	switch l := listener.(type) {
+	case *net.TCPListener:
+		return l.File()
+	case *net.UnixListener:
+		return l.File()
+	}
+	return nil, fmt.Errorf("Can't hand off %T listener", listener)
+}
+
+// notifyReady tells the process that started this one through handoffListeners
+// that the listeners are being served, so the old process can stop serving
+func notifyReady() {
+	fd := os.Getenv(READY_FD_ENV)
+	if len(fd) == 0 {
+		return
+	}
+	os.Unsetenv(READY_FD_ENV)
+	number, err := strconv.Atoi(fd)
+	if err != nil || number < LISTEN_FDS_START {
+		logError("Invalid "+READY_FD_ENV, fmt.Errorf("Expected a file descriptor, received: %s", fd))
+		return
+	}
+	file := os.NewFile(uintptr(number), "ready")
+	defer file.Close()
+	if _, err := io.WriteString(file, "READY=1\n"); err != nil {
+		logError("Unable to report readiness", err)
+	}
+}
+
+// waitForReady reads the readiness report of a new process. The pipe closes
+// without one when the process exits, for example on invalid flags.
+func waitForReady(ready *os.File) error {
+	ready.SetReadDeadline(time.Now().Add(READY_TIMEOUT))
+	line, err := bufio.NewReader(ready).ReadString('\n')
+	if strings.TrimSpace(line) == "READY=1" {
+		return nil
+	}
+	if err == io.EOF {
+		return errors.New("Exited before serving its listeners")
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return fmt.Errorf("Not serving after %v", READY_TIMEOUT)
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("Unexpected readiness report: %q", line)
+}
+
+// handoffListeners starts a new copy of the server binary with the same
+// arguments, passing it every listener through LISTEN_FDS. It returns once the
+// new process serves them, this process should then drain its connections and
+// exit. A process that fails to start is stopped and this one keeps serving.
+func handoffListeners(listeners []net.Listener, redirectListeners []net.Listener) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	var files []*os.File
+	var names []string
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for i, listener := range append(listeners, redirectListeners...) {
+		file, err := listenerFile(listener)
+		if err != nil {
+			return err
+		}
+		files = append(files, file)
+		// Names can't contain colons, the network is enough to tell them apart in logs
+		if i < len(listeners) {
+			names = append(names, listener.Addr().Network())
+		} else {
+			names = append(names, REDIRECT_FD_NAME)
+		}
+	}
+
+	// The new process writes to the end after the listeners, see notifyReady
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+	defer readyWriter.Close()
+
+	var env []string
+	for _, variable := range os.Environ() {
+		if !strings.HasPrefix(variable, "LISTEN_") && !strings.HasPrefix(variable, READY_FD_ENV+"=") {
+			env = append(env, variable)
+		}
+	}
+	unlink := "0"
+	if ownsSocketFiles {
+		unlink = "1"
+	}
+	env = append(env,
+		"LISTEN_FDS="+strconv.Itoa(len(files)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+		"LISTEN_UNLINK="+unlink,
+		READY_FD_ENV+"="+strconv.Itoa(LISTEN_FDS_START+len(files)))
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyWriter)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// Only the new process may hold the write end, or its exit never reads as EOF
+	readyWriter.Close()
+	debugf("Waiting for new process %d to serve its listeners...", cmd.Process.Pid)
+	if err := waitForReady(ready); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("New process %d: %v", cmd.Process.Pid, err)
+	}
+
+	for _, listener := range append(listeners, redirectListeners...) {
+		if unixListener, ok := listener.(*net.UnixListener); ok {
+			// The new process serves the socket now, closing ours mustn't remove it
+			unixListener.SetUnlinkOnClose(false)
+		}
+	}
+	fmt.Printf("Handed off %d listeners to new process %d\n", len(files), cmd.Process.Pid)
+	return nil
+}
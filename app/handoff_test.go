@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestNotifyReady(t *testing.T) {
+	ready, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ready.Close()
+	// notifyReady closes the descriptor it is given, hand it a copy of ours
+	fd, err := syscall.Dup(int(writer.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+
+	t.Setenv(READY_FD_ENV, strconv.Itoa(fd))
+	notifyReady()
+	if err := waitForReady(ready); err != nil {
+		t.Errorf("waitForReady after notifyReady = %v", err)
+	}
+	if value, set := os.LookupEnv(READY_FD_ENV); set {
+		t.Errorf("%s = %q left set for child processes", READY_FD_ENV, value)
+	}
+}
+
+func TestWaitForReadyFailures(t *testing.T) {
+	tests := []struct {
+		name   string
+		report string
+	}{
+		{"exited without a report", ""},
+		{"unexpected report", "STOPPING=1\n"},
+		{"incomplete report", "READY="},
+	}
+	for _, test := range tests {
+		ready, writer, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(writer, test.report)
+		writer.Close()
+		if err := waitForReady(ready); err == nil {
+			t.Errorf("%s: waitForReady reports the new process ready", test.name)
+		}
+		ready.Close()
+	}
+}
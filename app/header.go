@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Header Fields
+
+// Http_Header holds the header or trailer fields of a request or response.
+// Keys are stored in canonical form ("content-length" becomes "Content-Length")
+// and a field sent on several lines keeps one value per line.
+type Http_Header map[string][]string
+
+func canonicalHeaderKey(key string) string {
+	return textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(key))
+}
+
+// Get returns the first value of key, or "" when it isn't set
+func (h Http_Header) Get(key string) string {
+	values := h[canonicalHeaderKey(key)]
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// Values returns every value of key in the order they were added
+func (h Http_Header) Values(key string) []string {
+	return h[canonicalHeaderKey(key)]
+}
+
+// Has reports if key is set, even to an empty value
+func (h Http_Header) Has(key string) bool {
+	_, exists := h[canonicalHeaderKey(key)]
+	return exists
+}
+
+// Add appends value to the values of key
+func (h Http_Header) Add(key string, value string) {
+	key = canonicalHeaderKey(key)
+	h[key] = append(h[key], value)
+}
+
+// Set replaces every value of key with value
+func (h Http_Header) Set(key string, value string) {
+	h[canonicalHeaderKey(key)] = []string{value}
+}
+
+// Del removes key and all of its values
+func (h Http_Header) Del(key string) {
+	delete(h, canonicalHeaderKey(key))
+}
+
+// Clone returns a copy of h that can be changed without affecting h
+func (h Http_Header) Clone() Http_Header {
+	clone := make(Http_Header, len(h))
+	for key, values := range h {
+		clone[key] = append([]string(nil), values...)
+	}
+	return clone
+}
+
+// Keys returns the field names in h, sorted so output is deterministic
+func (h Http_Header) Keys() []string {
+	keys := make([]string, 0, len(h))
+	for key := range h {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// headerTokens splits every comma separated value of key into lower-cased
+// tokens, as used by Connection, Transfer-Encoding and Accept-Encoding
+func headerTokens(h Http_Header, key string) []string {
+	var tokens []string
+	for _, value := range h.Values(key) {
+		for _, token := range strings.Split(value, ",") {
+			token = strings.ToLower(strings.TrimSpace(token))
+			if len(token) > 0 {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	return tokens
+}
+
+// qualityValue reads the weight in the parameters of a token such as
+// "gzip;q=0.5". Without one it is 1, an unreadable weight counts as 0 so a
+// coding the client may have refused is never picked.
+func qualityValue(params string) float64 {
+	for _, param := range strings.Split(params, ";") {
+		name, value, _ := strings.Cut(param, "=")
+		if strings.TrimSpace(name) != "q" {
+			continue
+		}
+		quality, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || quality < 0 || quality > 1 {
+			return 0
+		}
+		return quality
+	}
+	return 1
+}
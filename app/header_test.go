@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestQualityValue(t *testing.T) {
+	tests := []struct {
+		params  string
+		quality float64
+	}{
+		{"", 1},
+		{"q=1", 1},
+		{"q=0.5", 0.5},
+		{" q = 0.5 ", 0.5},
+		{"level=1;q=0.2", 0.2},
+		{"q=0", 0},
+		{"q=0.000", 0},
+		{"q=", 0},
+		{"q=abc", 0},
+		{"q=-1", 0},
+		{"q=2", 0},
+	}
+	for _, test := range tests {
+		if quality := qualityValue(test.params); quality != test.quality {
+			t.Errorf("qualityValue(%q) = %v, want %v", test.params, quality, test.quality)
+		}
+	}
+}
+
+func TestCheckEncodingOptions(t *testing.T) {
+	define_encoders()
+	tests := []struct {
+		acceptEncoding string
+		encoding       string
+	}{
+		{"gzip", "gzip"},
+		{"br, gzip", "gzip"},
+		{"gzip;q=0.5", "gzip"},
+		{"GZIP ; q=1", "gzip"},
+		{"gzip;q=0", ""},
+		{"gzip; q=0.0, br", ""},
+		{"gzip;q=abc", ""},
+		{"br", ""},
+	}
+	for _, test := range tests {
+		req := Http_Request{Method: "GET", Target: "/", Version: HTTPV, Headers: make(Http_Header)}
+		req.Headers.Set("Accept-Encoding", test.acceptEncoding)
+		res := textResponse(200, "hello hello hello")
+		checkEncodingOptions(&req, &res)
+		if encoding := res.Headers.Get("Content-Encoding"); encoding != test.encoding {
+			t.Errorf("Accept-Encoding %q gave Content-Encoding %q, want %q", test.acceptEncoding, encoding, test.encoding)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+// Request Limits
+
+// Longest accepted request line in bytes, longer ones get 414
+var MAX_REQUEST_LINE = 8 * 1024
+
+// Most bytes accepted for the whole header section, more get 431
+var MAX_HEADER_BYTES = 64 * 1024
+
+// Most header lines accepted in one request, more get 431
+var MAX_HEADER_COUNT = 100
+
+// Largest accepted request body in bytes, 0 means no limit. Larger ones get 413
+var MAX_BODY_SIZE int64
+
+var errLineTooLong = errors.New("Line exceeds length limit")
+
+// readLimitedLine reads up to and including the next LF like ReadString, but
+// fails with errLineTooLong once more than limit bytes arrive without one.
+// At most limit bytes plus the reader's buffer are ever held in memory.
+func readLimitedLine(reader *bufio.Reader, limit int) (string, error) {
+	var line []byte
+	for {
+		fragment, err := reader.ReadSlice('\n')
+		if len(line)+len(fragment) > limit {
+			return "", errLineTooLong
+		}
+		line = append(line, fragment...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		return string(line), err
+	}
+}
+
+// maxBodyReader fails a body with 413 as soon as it grows past MAX_BODY_SIZE,
+// for chunked bodies whose size isn't known up front
+type maxBodyReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (m *maxBodyReader) Read(p []byte) (int, error) {
+	n, err := m.reader.Read(p)
+	m.remaining -= int64(n)
+	if m.remaining < 0 {
+		return n, newHttpError(413, "Request body exceeds the size limit.")
+	}
+	return n, err
+}
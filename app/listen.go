@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Listeners
+
+// Port used for --addr values that don't name one, set by --port
+var PORT = 4221
+
+// Addresses to listen on, set by --addr. Each is "host", "host:port",
+// "[ipv6]", "[ipv6]:port" or "unix:/path/to/socket".
+var LISTEN_ADDRS []string
+
+// Used when --addr isn't given
+const DEFAULT_LISTEN_ADDR = "0.0.0.0"
+
+// stringList is a flag that can be repeated or given a comma separated list
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			return fmt.Errorf("Empty value in list: %q", value)
+		}
+		*s = append(*s, item)
+	}
+	return nil
+}
+
+type listenAddress struct {
+	network string
+	address string
+}
+
+func (l listenAddress) String() string {
+	return l.network + ":" + l.address
+}
+
+// parseListenAddress turns an --addr value into a network and address for
+// net.Listen. TCP addresses use tcp, so 0.0.0.0 and :: accept IPv4 and IPv6
+// alike where the host supports it, see splitFamilies.
+func parseListenAddress(addr string, port int) (listenAddress, error) {
+	if path, isUnix := strings.CutPrefix(addr, "unix:"); isUnix {
+		if len(path) == 0 {
+			return listenAddress{}, fmt.Errorf("Missing socket path in %q", addr)
+		}
+		return listenAddress{network: "unix", address: path}, nil
+	}
+
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		// No port given, addr is just the host
+		host = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+		portString = strconv.Itoa(port)
+	}
+	portNumber, err := strconv.Atoi(portString)
+	if err != nil || portNumber < 0 || portNumber > 65535 {
+		return listenAddress{}, fmt.Errorf("Invalid port in %q", addr)
+	}
+
+	if net.ParseIP(host) == nil && strings.Contains(host, ":") {
+		return listenAddress{}, fmt.Errorf("Invalid host in %q", addr)
+	}
+	return listenAddress{network: "tcp", address: net.JoinHostPort(host, portString)}, nil
+}
+
+// splitFamilies gives unspecified addresses one family each when 0.0.0.0 and
+// :: are both bound on the same port, as either would take the port for both
+// families with tcp and the other would fail to bind.
+func splitFamilies(listenAddrs []listenAddress) {
+	unspecified := make(map[string][]int) // indexes into listenAddrs by port
+	for i, listenAddr := range listenAddrs {
+		if listenAddr.network != "tcp" {
+			continue
+		}
+		host, port, _ := net.SplitHostPort(listenAddr.address)
+		if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+			unspecified[port] = append(unspecified[port], i)
+		}
+	}
+	for _, indexes := range unspecified {
+		networks := make(map[string]bool)
+		for _, i := range indexes {
+			networks[addressFamily(listenAddrs[i].address)] = true
+		}
+		if !networks["tcp4"] || !networks["tcp6"] {
+			continue
+		}
+		for _, i := range indexes {
+			listenAddrs[i].network = addressFamily(listenAddrs[i].address)
+			debugf("Binding %s to one family, both are listed for its port", listenAddrs[i].address)
+		}
+	}
+}
+
+// addressFamily returns tcp4 or tcp6 for an IP literal "host:port"
+func addressFamily(address string) string {
+	host, _, _ := net.SplitHostPort(address)
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		return "tcp4"
+	}
+	return "tcp6"
+}
+
+// removeStaleSocket deletes a socket file left behind by a server that didn't
+// shut down cleanly. A socket something still answers on is left alone.
+func removeStaleSocket(path string) {
+	fileInfo, err := os.Lstat(path)
+	if err != nil || fileInfo.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return
+	}
+	debugf("Removing stale socket: %s", path)
+	os.Remove(path)
+}
+
+// openListeners binds every address in LISTEN_ADDRS and REDIRECT_ADDRS.
+// Failing to bind any of them is fatal, a server missing one of its addresses
+// is hard to notice. Inherited listeners take the place of both, see handoff.go.
+func openListeners() ([]net.Listener, []net.Listener) {
+	if inherited, inheritedRedirects := inheritedListeners(); len(inherited)+len(inheritedRedirects) > 0 {
+		if len(LISTEN_ADDRS)+len(REDIRECT_ADDRS) > 0 {
+			debugf("Using %d inherited listeners instead of --addr %v --redirect-addr %v",
+				len(inherited)+len(inheritedRedirects), LISTEN_ADDRS, REDIRECT_ADDRS)
+		}
+		return inherited, inheritedRedirects
+	}
+
+	addrs := LISTEN_ADDRS
+	if len(addrs) == 0 {
+		addrs = []string{DEFAULT_LISTEN_ADDR}
+	}
+	return bindListeners(addrs, PORT, "--addr"), bindListeners(REDIRECT_ADDRS, 80, "--redirect-addr")
+}
+
+// bindListeners listens on every address in addrs, port is used by those
+// that don't name one
+func bindListeners(addrs []string, port int, flagName string) []net.Listener {
+	var listenAddrs []listenAddress
+	for _, addr := range addrs {
+		listenAddr, err := parseListenAddress(addr, port)
+		if err != nil {
+			handleError(fmt.Sprintf("Invalid %s value", flagName), err)
+		}
+		listenAddrs = append(listenAddrs, listenAddr)
+	}
+	splitFamilies(listenAddrs)
+
+	var listeners []net.Listener
+	for _, listenAddr := range listenAddrs {
+		if listenAddr.network == "unix" {
+			removeStaleSocket(listenAddr.address)
+		}
+		listener, err := net.Listen(listenAddr.network, listenAddr.address)
+		if err != nil {
+			handleError(fmt.Sprintf("Failed to bind to %s", listenAddr), err)
+		}
+		fmt.Printf("Listening on %s (%s)\n", listenAddr, flagName)
+		listeners = append(listeners, listener)
+	}
+	return listeners
+}
+
+// acceptLoop hands every connection accepted by listener to handleConnection
+func acceptLoop(listener net.Listener, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			// Usually running out of file descriptors, back off instead of spinning
+			logError(fmt.Sprintf("Error accepting connection on %s.", listener.Addr()), err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		if !connections.track(conn) {
+			// Shutdown began while this connection was being accepted
+			conn.Close()
+			continue
+		}
+		go handleConnection(conn)
+	}
+}
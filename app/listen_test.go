@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func TestParseListenAddress(t *testing.T) {
+	tests := []struct {
+		addr    string
+		network string
+		address string
+		valid   bool
+	}{
+		{"0.0.0.0", "tcp", "0.0.0.0:4221", true},
+		{"::", "tcp", "[::]:4221", true},
+		{"[::]", "tcp", "[::]:4221", true},
+		{"127.0.0.1:8080", "tcp", "127.0.0.1:8080", true},
+		{"[::1]:8080", "tcp", "[::1]:8080", true},
+		{"localhost", "tcp", "localhost:4221", true},
+		{":8080", "tcp", ":8080", true},
+		{"unix:/tmp/s.sock", "unix", "/tmp/s.sock", true},
+		{"unix:", "", "", false},
+		{"127.0.0.1:http", "", "", false},
+		{"127.0.0.1:70000", "", "", false},
+	}
+	for _, test := range tests {
+		listenAddr, err := parseListenAddress(test.addr, 4221)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("parseListenAddress(%q) error = %v, want valid %v", test.addr, err, test.valid)
+			continue
+		}
+		if listenAddr.network != test.network || listenAddr.address != test.address {
+			t.Errorf("parseListenAddress(%q) = %s, want %s:%s", test.addr, listenAddr, test.network, test.address)
+		}
+	}
+}
+
+func TestSplitFamilies(t *testing.T) {
+	tests := []struct {
+		name     string
+		addrs    []listenAddress
+		networks []string
+	}{
+		{"default stays dual-stack", []listenAddress{{"tcp", "0.0.0.0:4221"}}, []string{"tcp"}},
+		{"IPv6 alone stays dual-stack", []listenAddress{{"tcp", "[::]:4221"}}, []string{"tcp"}},
+		{"both families on one port", []listenAddress{{"tcp", "0.0.0.0:4221"}, {"tcp", "[::]:4221"}}, []string{"tcp4", "tcp6"}},
+		{"both families on different ports", []listenAddress{{"tcp", "0.0.0.0:80"}, {"tcp", "[::]:4221"}}, []string{"tcp", "tcp"}},
+		{"specific addresses", []listenAddress{{"tcp", "127.0.0.1:4221"}, {"tcp", "[::1]:4221"}}, []string{"tcp", "tcp"}},
+		{"unix socket", []listenAddress{{"unix", "/tmp/s.sock"}, {"tcp", "[::]:4221"}}, []string{"unix", "tcp"}},
+	}
+	for _, test := range tests {
+		splitFamilies(test.addrs)
+		for i, listenAddr := range test.addrs {
+			if listenAddr.network != test.networks[i] {
+				t.Errorf("%s: %s has network %s, want %s", test.name, listenAddr.address, listenAddr.network, test.networks[i])
+			}
+		}
+	}
+}
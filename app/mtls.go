@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+)
+
+// Client Certificates (mutual TLS)
+
+// CA bundle that client certificates are verified against, set by --tls-client-ca
+var TLS_CLIENT_CA string
+
+// TLS_CLIENT_AUTH is set by --tls-client-auth. With "optional" a client may
+// send a certificate and routes decide if they need one, "require" refuses
+// the handshake without one.
+var TLS_CLIENT_AUTH = "optional"
+
+// Route_Policy holds the access rules of a route, see Http_Router.SetPolicy
+type Route_Policy struct {
+	// Only clients with a verified certificate may use the route
+	RequireClientCert bool
+}
+
+// configureClientAuth adds client certificate verification to config when
+// --tls-client-ca is set
+func configureClientAuth(config *tls.Config) error {
+	if len(TLS_CLIENT_CA) == 0 {
+		return nil
+	}
+	bundle, err := os.ReadFile(TLS_CLIENT_CA)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return fmt.Errorf("No certificates found in %s", TLS_CLIENT_CA)
+	}
+	config.ClientCAs = pool
+	switch TLS_CLIENT_AUTH {
+	case "optional":
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return fmt.Errorf("Expected optional or require, received: %s", TLS_CLIENT_AUTH)
+	}
+	debugf("Verifying client certificates against %s, %s", TLS_CLIENT_CA, TLS_CLIENT_AUTH)
+	return nil
+}
+
+// verifiedClientSubject returns the subject of the certificate the client
+// authenticated with, or "" when the connection has none
+func verifiedClientSubject(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return state.VerifiedChains[0][0].Subject.String()
+}
+
+// checkRoutePolicy returns the response refusing req on the route of entry,
+// or nil when the request may go ahead. Policies only apply once client
+// certificates are configured.
+func checkRoutePolicy(entry *routeEntry, req Http_Request) *Http_Response {
+	if len(TLS_CLIENT_CA) == 0 {
+		return nil
+	}
+	if entry.policy.RequireClientCert && len(req.ClientSubject) == 0 {
+		debugf("Route %s requires a client certificate", entry.pattern)
+		res := textResponse(403, "A client certificate is required.")
+		return &res
+	}
+	return nil
+}
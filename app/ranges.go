@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Byte Range Requests (RFC 9110 section 14)
+
+// More ranges than this in one request are ignored and the whole file is sent
+var MAX_RANGES = 32
+
+var errRangeNotSatisfiable = errors.New("No requested range overlaps the file")
+
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseRange parses a Range header against a file of the given size. A header
+// that can't be parsed returns no ranges and no error, it is ignored as RFC 9110
+// requires. errRangeNotSatisfiable is returned when no range overlaps the file.
+func parseRange(header string, size int64) ([]byteRange, error) {
+	unit, rangeSet, found := strings.Cut(header, "=")
+	if !found || !strings.EqualFold(strings.TrimSpace(unit), "bytes") {
+		debugf("Ignoring Range with unsupported unit: %s", header)
+		return nil, nil
+	}
+
+	var ranges []byteRange
+	specs := strings.Split(rangeSet, ",")
+	if len(specs) > MAX_RANGES {
+		debugf("Ignoring Range with %d ranges", len(specs))
+		return nil, nil
+	}
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if len(spec) == 0 {
+			continue
+		}
+		first, last, found := strings.Cut(spec, "-")
+		if !found {
+			debugf("Ignoring malformed Range spec: %s", spec)
+			return nil, nil
+		}
+		first = strings.TrimSpace(first)
+		last = strings.TrimSpace(last)
+
+		if len(first) == 0 {
+			// Suffix range: the final N bytes of the file
+			suffix, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || suffix < 0 {
+				debugf("Ignoring malformed suffix range: %s", spec)
+				return nil, nil
+			}
+			if suffix == 0 || size == 0 {
+				continue
+			}
+			if suffix > size {
+				suffix = size
+			}
+			ranges = append(ranges, byteRange{start: size - suffix, length: suffix})
+			continue
+		}
+
+		start, err := strconv.ParseInt(first, 10, 64)
+		if err != nil || start < 0 {
+			debugf("Ignoring malformed range start: %s", spec)
+			return nil, nil
+		}
+		end := size - 1
+		if len(last) > 0 {
+			end, err = strconv.ParseInt(last, 10, 64)
+			if err != nil || end < start {
+				debugf("Ignoring malformed range end: %s", spec)
+				return nil, nil
+			}
+			if end > size-1 {
+				end = size - 1
+			}
+		}
+		if start >= size {
+			// Doesn't overlap, other ranges in the set still might
+			continue
+		}
+		ranges = append(ranges, byteRange{start: start, length: end - start + 1})
+	}
+
+	if len(ranges) == 0 {
+		return nil, errRangeNotSatisfiable
+	}
+	return ranges, nil
+}
+
+// ifRangeMatches reports if the representation still matches the If-Range
+// validator, meaning the Range header may be honoured
+func ifRangeMatches(req Http_Request, fileInfo os.FileInfo) bool {
+	ifRange := strings.TrimSpace(req.Headers.Get("If-Range"))
+	if len(ifRange) == 0 {
+		return true
+	}
+	if strings.HasPrefix(ifRange, "\"") || strings.HasPrefix(ifRange, "W/") {
+		// If-Range always uses strong comparison
+		return etagMatches(ifRange, fileETag(fileInfo), false)
+	}
+	date, err := parseHTTPDate(ifRange)
+	if err != nil {
+		debugf("Ignoring Range, invalid If-Range date: %s", ifRange)
+		return false
+	}
+	// Dates only validate a range when they match exactly
+	return lastModified(fileInfo).Equal(date)
+}
+
+// multipartBody streams the parts of a multipart/byteranges response and closes
+// the file once the response is sent
+type multipartBody struct {
+	io.Reader
+	file *os.File
+}
+
+func (m *multipartBody) Close() error {
+	return m.file.Close()
+}
+
+func newBoundary() string {
+	buf := make([]byte, 12)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// applyRanges turns the file response in res into a 206 Partial Content, or a
+// 416 Range Not Satisfiable, response when req carries a usable Range header
+func applyRanges(req Http_Request, res *Http_Response, file *os.File, fileInfo os.FileInfo) error {
+	res.Headers.Set("Accept-Ranges", "bytes")
+	rangeHeader := req.Headers.Get("Range")
+	if !req.Headers.Has("Range") || req.Method != "GET" {
+		return nil
+	}
+	if !ifRangeMatches(req, fileInfo) {
+		debug("If-Range failed, sending whole file")
+		return nil
+	}
+
+	size := fileInfo.Size()
+	ranges, err := parseRange(rangeHeader, size)
+	if err == errRangeNotSatisfiable {
+		debugf("Range not satisfiable: %s", rangeHeader)
+		file.Close()
+		res.BodyReader = nil
+		setStatus(res, 416)
+		res.Headers.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		res.Headers.Set("Content-Length", "0")
+		return nil
+	}
+	if len(ranges) == 0 {
+		return nil
+	}
+
+	setStatus(res, 206)
+	if len(ranges) == 1 {
+		debugf("Sending single range: %v", ranges[0])
+		if _, err := file.Seek(ranges[0].start, io.SeekStart); err != nil {
+			return err
+		}
+		res.Headers.Set("Content-Range", ranges[0].contentRange(size))
+		res.Headers.Set("Content-Length", strconv.FormatInt(ranges[0].length, 10))
+		res.BodyReader = &fileBody{LimitedReader: io.LimitedReader{R: file, N: ranges[0].length}, file: file}
+		return nil
+	}
+
+	debugf("Sending %d ranges as multipart/byteranges", len(ranges))
+	boundary := newBoundary()
+	contentType := res.Headers.Get("Content-Type")
+	var parts []io.Reader
+	var contentLength int64
+	for i, r := range ranges {
+		partHeader := fmt.Sprintf("--%s\r\nContent-Type: %s\r\nContent-Range: %s\r\n\r\n", boundary, contentType, r.contentRange(size))
+		if i > 0 {
+			partHeader = CRLF + partHeader
+		}
+		parts = append(parts, strings.NewReader(partHeader), io.NewSectionReader(file, r.start, r.length))
+		contentLength += int64(len(partHeader)) + r.length
+	}
+	closing := fmt.Sprintf("\r\n--%s--\r\n", boundary)
+	parts = append(parts, strings.NewReader(closing))
+	contentLength += int64(len(closing))
+
+	res.Headers.Set("Content-Type", "multipart/byteranges; boundary="+boundary)
+	res.Headers.Set("Content-Length", strconv.FormatInt(contentLength, 10))
+	res.BodyReader = &multipartBody{Reader: io.MultiReader(parts...), file: file}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// HTTPS Redirects
+
+// Plaintext addresses that redirect to HTTPS, set by --redirect-addr
+var REDIRECT_ADDRS []string
+
+// Route patterns served normally on the redirect listeners instead of being
+// redirected, such as "GET /files/{path...}". Each must match a registered
+// route, see define_routes. Set by --redirect-exempt.
+var REDIRECT_EXEMPT []string
+
+// REDIRECT_EXEMPT matched like routes, its handlers are never called
+var redirectExemptions = newRouter()
+
+// Port redirects point to, that of the first HTTPS listener
+var HTTPS_PORT = "443"
+
+// redirectListener marks the connections it accepts as redirectConn
+type redirectListener struct {
+	net.Listener
+}
+
+func (l redirectListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &redirectConn{conn}, nil
+}
+
+// redirectConn is a plaintext connection whose requests redirect to HTTPS
+type redirectConn struct {
+	net.Conn
+}
+
+// shouldRedirect reports if req arrived on a redirect listener and isn't exempt
+func shouldRedirect(conn net.Conn, req Http_Request) bool {
+	if _, plain := conn.(*redirectConn); !plain {
+		return false
+	}
+	if req.Target == "*" {
+		// OPTIONS * is about this server, there is no URL to redirect it to
+		return false
+	}
+	exempt, _ := redirectExemptions.Match(req.Method, req.Target)
+	if exempt != nil {
+		debugf("Route pattern exempt from redirect: %s", exempt.pattern)
+	}
+	return exempt == nil
+}
+
+// httpsRedirect sends the client to the https:// URL of req. GET and HEAD get a
+// 301, other methods a 308 so clients repeat them with the same method and body.
+func httpsRedirect(req Http_Request) Http_Response {
+	host := req.Headers.Get("Host")
+	if len(host) == 0 {
+		return textResponse(400, "A Host header is required.")
+	}
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + strings.Trim(host, "[]") + "]"
+	}
+	if HTTPS_PORT != "443" {
+		host += ":" + HTTPS_PORT
+	}
+
+	status := 308
+	if req.Method == "GET" || req.Method == "HEAD" {
+		status = 301
+	}
+	location := "https://" + host + req.Target
+	debugf("Redirecting to %s", location)
+	res := newResponse(status)
+	res.Headers.Set("Location", location)
+	return res
+}
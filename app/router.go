@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Routing
+
+// Route_Handler serves a request matched by a route. params holds the path
+// segments matched by the named parameters of the route pattern.
+type Route_Handler func(params map[string]string, conn net.Conn, req Http_Request) Http_Response
+
+// Http_Router matches requests against patterns such as "GET /echo/{str}".
+// A pattern is a method and a path made of literal segments, {name}
+// parameters matching one non-empty segment anywhere in the path, and an
+// optional final {name...} catch-all matching the rest of the path. A
+// catch-all needs its segment to be there, "/files/{path...}" matches
+// "/files/" with an empty path but not "/files".
+// Literal segments win over parameters, parameters over catch-alls.
+type Http_Router struct {
+	mutex sync.RWMutex
+	root  *routeNode
+	// Every entry by its pattern
+	patterns map[string]*routeEntry
+}
+
+// routeEntry is what a pattern registers for one method
+type routeEntry struct {
+	pattern string
+	handler Route_Handler
+	policy  Route_Policy
+}
+
+// routeNode is one path segment in the router's trie
+type routeNode struct {
+	static map[string]*routeNode
+	// Child matching any single segment, stored under its parameter name
+	param     *routeNode
+	paramName string
+	// Entries of a {name...} catch-all ending here, by method
+	catchAll     map[string]*routeEntry
+	catchAllName string
+	// Entries of patterns ending exactly here, by method
+	entries map[string]*routeEntry
+}
+
+func newRouteNode() *routeNode {
+	return &routeNode{static: make(map[string]*routeNode)}
+}
+
+func newRouter() *Http_Router {
+	return &Http_Router{root: newRouteNode(), patterns: make(map[string]*routeEntry)}
+}
+
+// splitPath breaks a path into its segments, "/" has none
+func splitPath(path string) []string {
+	if path == "/" {
+		return nil
+	}
+	return strings.Split(strings.TrimPrefix(path, "/"), "/")
+}
+
+// parsePattern splits "METHOD /path" and checks the path is well formed
+func parsePattern(pattern string) (string, []string, error) {
+	method, path, found := strings.Cut(pattern, " ")
+	if !found || !isToken(method) || !strings.HasPrefix(path, "/") {
+		return "", nil, fmt.Errorf("Expected \"METHOD /path\", received: %q", pattern)
+	}
+	segments := splitPath(path)
+	for i, segment := range segments {
+		if !strings.HasPrefix(segment, "{") && !strings.ContainsAny(segment, "{}") {
+			continue
+		}
+		if !strings.HasPrefix(segment, "{") || !strings.HasSuffix(segment, "}") || len(segment) < 3 {
+			return "", nil, fmt.Errorf("Parameters must be a whole segment in %q", pattern)
+		}
+		if strings.HasSuffix(segment, "...}") && i != len(segments)-1 {
+			return "", nil, fmt.Errorf("Catch-all must be the last segment in %q", pattern)
+		}
+	}
+	return method, segments, nil
+}
+
+// Handle registers handler for pattern. Invalid or duplicate patterns are
+// programming mistakes and stop the server at startup.
+func (r *Http_Router) Handle(pattern string, handler Route_Handler) {
+	method, segments, err := parsePattern(pattern)
+	if err != nil {
+		handleError("Invalid route pattern", err)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, exists := r.patterns[pattern]; exists {
+		handleError("Duplicate route pattern", fmt.Errorf("%q is already registered", pattern))
+	}
+
+	node := r.root
+	entries := &node.entries
+	for i, segment := range segments {
+		if name, isCatchAll := strings.CutSuffix(strings.Trim(segment, "{}"), "..."); isCatchAll && strings.HasPrefix(segment, "{") {
+			if node.catchAll != nil && node.catchAllName != name {
+				handleError("Conflicting route pattern", fmt.Errorf("%q renames catch-all {%s...}", pattern, node.catchAllName))
+			}
+			if node.catchAll == nil {
+				node.catchAll = make(map[string]*routeEntry)
+			}
+			node.catchAllName = name
+			entries = &node.catchAll
+			break
+		}
+		if strings.HasPrefix(segment, "{") {
+			name := strings.Trim(segment, "{}")
+			if node.param != nil && node.paramName != name {
+				handleError("Conflicting route pattern", fmt.Errorf("%q renames parameter {%s}", pattern, node.paramName))
+			}
+			if node.param == nil {
+				node.param = newRouteNode()
+				node.paramName = name
+			}
+			node = node.param
+		} else {
+			child, exists := node.static[segment]
+			if !exists {
+				child = newRouteNode()
+				node.static[segment] = child
+			}
+			node = child
+		}
+		if i == len(segments)-1 {
+			entries = &node.entries
+		}
+	}
+
+	if *entries == nil {
+		*entries = make(map[string]*routeEntry)
+	}
+	if existing, exists := (*entries)[method]; exists {
+		// Same shape under different parameter names, such as /a/{x} and /a/{y}
+		handleError("Duplicate route pattern", fmt.Errorf("%q matches the same requests as %q", pattern, existing.pattern))
+	}
+	entry := &routeEntry{pattern: pattern, handler: handler}
+	(*entries)[method] = entry
+	r.patterns[pattern] = entry
+	debugf("Route registered: %s", pattern)
+}
+
+// SetPolicy sets the access rules of an already registered pattern
+func (r *Http_Router) SetPolicy(pattern string, policy Route_Policy) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	entry, exists := r.patterns[pattern]
+	if !exists {
+		handleError("Invalid route policy", fmt.Errorf("No route registered for %q", pattern))
+	}
+	entry.policy = policy
+}
+
+// walk calls visit with the entries of every route matching segments, most
+// specific first, until visit returns true. params holds the parameters
+// matched on the way to those entries.
+func (n *routeNode) walk(segments []string, params map[string]string, visit func(map[string]*routeEntry, map[string]string) bool) bool {
+	if len(segments) == 0 {
+		if n.entries != nil && visit(n.entries, params) {
+			return true
+		}
+	} else {
+		if child, exists := n.static[segments[0]]; exists {
+			if child.walk(segments[1:], params, visit) {
+				return true
+			}
+		}
+		if n.param != nil && len(segments[0]) > 0 {
+			params[n.paramName] = segments[0]
+			if n.param.walk(segments[1:], params, visit) {
+				return true
+			}
+			delete(params, n.paramName)
+		}
+	}
+	if n.catchAll != nil && len(segments) > 0 {
+		params[n.catchAllName] = strings.Join(segments, "/")
+		if visit(n.catchAll, params) {
+			return true
+		}
+		delete(params, n.catchAllName)
+	}
+	return false
+}
+
+// Serves reports if a request matching pattern would reach one of the routes,
+// tried with a path that fills every parameter with a sample segment
+func (r *Http_Router) Serves(pattern string) bool {
+	method, segments, err := parsePattern(pattern)
+	if err != nil {
+		return false
+	}
+	sample := make([]string, len(segments))
+	for i, segment := range segments {
+		sample[i] = segment
+		if strings.HasPrefix(segment, "{") {
+			sample[i] = "x"
+		}
+	}
+	entry, _ := r.Match(method, "/"+strings.Join(sample, "/"))
+	return entry != nil
+}
+
+// requestPath returns the path of a target for matching, without its query
+func requestPath(target string) string {
+	path, _, _ := strings.Cut(target, "?")
+	return path
+}
+
+// Match returns the entry for method and the path of target, along with the
+// parameters it matched, or nil when no route matches
+func (r *Http_Router) Match(method string, target string) (*routeEntry, map[string]string) {
+	path := requestPath(target)
+	if !strings.HasPrefix(path, "/") {
+		return nil, nil
+	}
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	var matched *routeEntry
+	var matchedParams map[string]string
+	r.root.walk(splitPath(path), make(map[string]string), func(entries map[string]*routeEntry, params map[string]string) bool {
+		entry, exists := entries[method]
+		if !exists {
+			return false
+		}
+		matched = entry
+		// walk keeps changing params while it backtracks, hand out a copy
+		matchedParams = make(map[string]string, len(params))
+		for name, value := range params {
+			matchedParams[name] = value
+		}
+		return true
+	})
+	if matched != nil {
+		debugf("Route matched: %s %v", matched.pattern, matchedParams)
+	}
+	return matched, matchedParams
+}
+
+// Allowed returns the methods registered for the path of target, sorted. The
+// asterisk-form target "*" stands for the whole server.
+func (r *Http_Router) Allowed(target string) []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	methods := make(map[string]bool)
+	if target == "*" {
+		for pattern := range r.patterns {
+			method, _, _ := strings.Cut(pattern, " ")
+			methods[method] = true
+		}
+	} else if path := requestPath(target); strings.HasPrefix(path, "/") {
+		r.root.walk(splitPath(path), make(map[string]string), func(entries map[string]*routeEntry, params map[string]string) bool {
+			for method := range entries {
+				methods[method] = true
+			}
+			// Keep walking, a less specific route may add other methods
+			return false
+		})
+	}
+
+	allowed := make([]string, 0, len(methods))
+	for method := range methods {
+		allowed = append(allowed, method)
+	}
+	sort.Strings(allowed)
+	return allowed
+}
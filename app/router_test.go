@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestRouterMatch(t *testing.T) {
+	router := newRouter()
+	noop := func(params map[string]string, conn net.Conn, req Http_Request) Http_Response {
+		return newResponse(200)
+	}
+	for _, pattern := range []string{
+		"GET /",
+		"GET /echo/{str}",
+		"GET /files/{path...}",
+		"POST /files/{path...}",
+		"GET /files/special",
+	} {
+		router.Handle(pattern, noop)
+	}
+
+	tests := []struct {
+		method  string
+		target  string
+		pattern string
+		params  map[string]string
+	}{
+		{"GET", "/", "GET /", map[string]string{}},
+		{"GET", "/echo/abc", "GET /echo/{str}", map[string]string{"str": "abc"}},
+		{"GET", "/echo/", "", nil},
+		{"GET", "/echo/a/b", "", nil},
+		{"GET", "/files/special", "GET /files/special", map[string]string{}},
+		{"GET", "/files/a/b.txt?x=1", "GET /files/{path...}", map[string]string{"path": "a/b.txt"}},
+		{"GET", "/files/", "GET /files/{path...}", map[string]string{"path": ""}},
+		{"POST", "/files/a", "POST /files/{path...}", map[string]string{"path": "a"}},
+		// The catch-all segment must be there, even if empty
+		{"GET", "/files", "", nil},
+		{"DELETE", "/files", "", nil},
+		{"DELETE", "/files/a", "", nil},
+	}
+	for _, test := range tests {
+		entry, params := router.Match(test.method, test.target)
+		pattern := ""
+		if entry != nil {
+			pattern = entry.pattern
+		}
+		if pattern != test.pattern {
+			t.Errorf("Match(%s %s) = %q, want %q", test.method, test.target, pattern, test.pattern)
+			continue
+		}
+		if len(params) != len(test.params) {
+			t.Errorf("Match(%s %s) params = %v, want %v", test.method, test.target, params, test.params)
+			continue
+		}
+		for name, value := range test.params {
+			if params[name] != value {
+				t.Errorf("Match(%s %s) params = %v, want %v", test.method, test.target, params, test.params)
+				break
+			}
+		}
+	}
+}
+
+func TestRouterAllowed(t *testing.T) {
+	router := newRouter()
+	noop := func(params map[string]string, conn net.Conn, req Http_Request) Http_Response {
+		return newResponse(200)
+	}
+	router.Handle("GET /files/{path...}", noop)
+	router.Handle("POST /files/{path...}", noop)
+	router.Handle("DELETE /files/special", noop)
+
+	tests := []struct {
+		target  string
+		allowed string
+	}{
+		{"/files/a", "GET POST"},
+		{"/files/special", "DELETE GET POST"},
+		{"/files", ""},
+		{"*", "DELETE GET POST"},
+	}
+	for _, test := range tests {
+		allowed := strings.Join(router.Allowed(test.target), " ")
+		if allowed != test.allowed {
+			t.Errorf("Allowed(%s) = %q, want %q", test.target, allowed, test.allowed)
+		}
+	}
+}
+
+func TestRouterServes(t *testing.T) {
+	router := newRouter()
+	noop := func(params map[string]string, conn net.Conn, req Http_Request) Http_Response {
+		return newResponse(200)
+	}
+	router.Handle("GET /", noop)
+	router.Handle("GET /echo/{str}", noop)
+	router.Handle("GET /files/{path...}", noop)
+
+	tests := []struct {
+		pattern string
+		serves  bool
+	}{
+		{"GET /", true},
+		{"GET /echo/{str}", true},
+		{"GET /echo/{other}", true},
+		{"GET /files/{path...}", true},
+		{"GET /files/{name}", true},
+		{"GET /files/acme/{token}", true},
+		{"POST /files/{path...}", false},
+		{"GET /.well-known/acme-challenge/{str}", false},
+		{"GET /echo", false},
+		{"GET /{path...}", false},
+		{"not a pattern", false},
+	}
+	for _, test := range tests {
+		if serves := router.Serves(test.pattern); serves != test.serves {
+			t.Errorf("Serves(%q) = %v, want %v", test.pattern, serves, test.serves)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// File Sandbox
+
+// Set by --follow-external-symlinks, lets symlinks inside DIRPATH point anywhere
+var FOLLOW_EXTERNAL_SYMLINKS bool
+
+func forbiddenPath(msg string) error {
+	return newHttpError(403, msg)
+}
+
+// sandboxRoot is the served directory with symlinks resolved
+func sandboxRoot() (string, error) {
+	root := DIRPATH
+	if len(root) == 0 {
+		root = "."
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(root)
+}
+
+// withinRoot reports if target is root or somewhere below it
+func withinRoot(root string, target string) bool {
+	rel, err := filepath.Rel(root, target)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator))
+}
+
+// resolveExisting resolves symlinks in the longest existing prefix of target,
+// so paths of files that are about to be created can be checked too. A prefix
+// that runs into a file counts as missing, the handlers report it.
+func resolveExisting(target string) (string, error) {
+	missing := ""
+	for {
+		resolved, err := filepath.EvalSymlinks(target)
+		if err == nil {
+			return filepath.Join(resolved, missing), nil
+		}
+		if !os.IsNotExist(err) && !errors.Is(err, syscall.ENOTDIR) {
+			return "", err
+		}
+		parent := filepath.Dir(target)
+		if parent == target {
+			return "", err
+		}
+		missing = filepath.Join(filepath.Base(target), missing)
+		target = parent
+	}
+}
+
+func isControlRune(r rune) bool {
+	return r < 0x20 || r == 0x7f
+}
+
+// sandboxPath maps the raw file name taken from a request target to a path
+// inside DIRPATH. Percent-encoding is decoded first and names with control
+// characters get a 400, then any ".." segment or symlink leading outside
+// DIRPATH is refused with a 403 Http_Error. The same check guards reads and
+// writes.
+func sandboxPath(name string) (string, error) {
+	decoded, err := url.PathUnescape(name)
+	if err != nil {
+		return "", newHttpError(400, "Invalid percent-encoding in file name.")
+	}
+	debugf("Decoded file name: %s", decoded)
+	if strings.ContainsRune(decoded, 0) {
+		return "", forbiddenPath("File name contains a NUL byte.")
+	}
+	if strings.ContainsFunc(decoded, isControlRune) {
+		// The name ends up in headers such as Content-Disposition
+		return "", newHttpError(400, "File name contains control characters.")
+	}
+
+	// Treat backslashes as separators too, so Windows style escapes are caught
+	slashed := strings.ReplaceAll(decoded, "\\", "/")
+	for _, segment := range strings.Split(slashed, "/") {
+		if segment == ".." {
+			return "", forbiddenPath("File name must not contain '..' segments.")
+		}
+	}
+	cleaned := path.Clean("/" + slashed)
+	if cleaned == "/" {
+		return "", forbiddenPath("File name must not be empty.")
+	}
+
+	root, err := sandboxRoot()
+	if err != nil {
+		debugf("Unable to resolve served directory: %v", err)
+		return "", newHttpError(500, "Unable to resolve served directory.")
+	}
+	target := filepath.Join(root, filepath.FromSlash(cleaned))
+	if !withinRoot(root, target) {
+		return "", forbiddenPath("File name escapes the served directory.")
+	}
+
+	if !FOLLOW_EXTERNAL_SYMLINKS {
+		resolved, err := resolveExisting(target)
+		if err != nil {
+			debugf("Unable to resolve symlinks of %s: %v", target, err)
+			return "", forbiddenPath("Unable to resolve file path.")
+		}
+		if !withinRoot(root, resolved) {
+			debugf("Symlink from %s leads outside the sandbox to %s", target, resolved)
+			return "", forbiddenPath("File name resolves outside the served directory.")
+		}
+	}
+	debugf("Sandboxed path: %s", target)
+	return target, nil
+}
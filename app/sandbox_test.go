@@ -0,0 +1,137 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setSandbox serves a fresh directory for the rest of the test: it holds
+// a.txt, sub/b.txt, a symlink to a.txt and one to a file outside of it
+func setSandbox(t *testing.T) string {
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(root, "served")
+	outside := filepath.Join(root, "secret.txt")
+	for _, path := range []string{filepath.Join(dir, "a.txt"), filepath.Join(dir, "sub", "b.txt"), outside} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(dir, "a.txt"), filepath.Join(dir, "inside-link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "outside-link")); err != nil {
+		t.Fatal(err)
+	}
+
+	previous, previousFollow := DIRPATH, FOLLOW_EXTERNAL_SYMLINKS
+	DIRPATH = dir + "/"
+	t.Cleanup(func() {
+		DIRPATH = previous
+		FOLLOW_EXTERNAL_SYMLINKS = previousFollow
+	})
+	return dir
+}
+
+func TestSandboxPath(t *testing.T) {
+	dir := setSandbox(t)
+	tests := []struct {
+		name   string
+		path   string
+		status int
+	}{
+		{"a.txt", "a.txt", 0},
+		{"sub/b.txt", "sub/b.txt", 0},
+		{"sub%2Fb.txt", "sub/b.txt", 0},
+		{"a%20b.txt", "a b.txt", 0},
+		{"new/dir/c.txt", "new/dir/c.txt", 0},
+		{"sub//b.txt", "sub/b.txt", 0},
+		{"./a.txt", "a.txt", 0},
+		{"inside-link", "inside-link", 0},
+		{"../secret.txt", "", 403},
+		{"sub/../../secret.txt", "", 403},
+		{"%2e%2e/secret.txt", "", 403},
+		{"..%2fsecret.txt", "", 403},
+		{"..\\secret.txt", "", 403},
+		{"..%5csecret.txt", "", 403},
+		{"outside-link", "", 403},
+		{"outside-link/x", "", 403},
+		{"a.txt%00.png", "", 403},
+		{"", "", 403},
+		{"%2f", "", 403},
+		{"nope%0d%0aSet-Cookie:%20evil=1", "", 400},
+		{"a%09b", "", 400},
+		{"a%7f", "", 400},
+		{"%zz", "", 400},
+	}
+	for _, test := range tests {
+		path, err := sandboxPath(test.name)
+		if status := errorStatus(err); status != test.status {
+			t.Errorf("sandboxPath(%q) status = %d, want %d (error: %v)", test.name, status, test.status, err)
+			continue
+		}
+		if want := filepath.Join(dir, filepath.FromSlash(test.path)); err == nil && path != want {
+			t.Errorf("sandboxPath(%q) = %q, want %q", test.name, path, want)
+		}
+	}
+}
+
+func TestSandboxPathFollowExternalSymlinks(t *testing.T) {
+	dir := setSandbox(t)
+	FOLLOW_EXTERNAL_SYMLINKS = true
+	path, err := sandboxPath("outside-link")
+	if err != nil || path != filepath.Join(dir, "outside-link") {
+		t.Errorf("sandboxPath(%q) = %q, %v, want the link inside the served directory", "outside-link", path, err)
+	}
+	// Only symlinks may lead outside, ".." still may not
+	if _, err := sandboxPath("../secret.txt"); errorStatus(err) != 403 {
+		t.Errorf("sandboxPath(%q) error = %v, want 403", "../secret.txt", err)
+	}
+}
+
+func TestFileRequestContentDisposition(t *testing.T) {
+	dir := setSandbox(t)
+	for _, name := range []string{"quote\"d.txt", "semi;colon.txt", "é.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		path        string
+		status      int
+		disposition string
+	}{
+		{"a.txt", 200, "attachment; filename=a.txt"},
+		{"sub/b.txt", 200, "attachment; filename=b.txt"},
+		{"quote%22d.txt", 200, "attachment; filename=\"quote\\\"d.txt\""},
+		{"semi;colon.txt", 200, "attachment; filename=\"semi;colon.txt\""},
+		{"%C3%A9.txt", 200, "attachment; filename*=utf-8''%C3%A9.txt"},
+		{"nope.txt", 404, ""},
+		{"nope%0d%0aSet-Cookie:%20evil=1", 400, ""},
+	}
+	for _, test := range tests {
+		req := Http_Request{Method: "GET", Target: "/files/" + test.path, Version: HTTPV, Headers: make(Http_Header)}
+		res := fileRequestHandler(map[string]string{"path": test.path}, nil, req)
+		discardBody(res)
+		if res.Status != test.status {
+			t.Errorf("GET /files/%s status = %d, want %d", test.path, res.Status, test.status)
+		}
+		if disposition := res.Headers.Get("Content-Disposition"); disposition != test.disposition {
+			t.Errorf("GET /files/%s Content-Disposition = %q, want %q", test.path, disposition, test.disposition)
+		}
+		for name, values := range res.Headers {
+			for _, value := range values {
+				if strings.ContainsAny(value, "\r\n") {
+					t.Errorf("GET /files/%s header %s = %q holds a line break", test.path, name, value)
+				}
+			}
+		}
+	}
+}
@@ -4,15 +4,21 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"mime"
 	"net"
 	"os"
-	"regexp"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -20,8 +26,33 @@ import (
 var DEBUGGER bool
 var DIRPATH string
 
+// How many pipelined requests on one connection may await their response at once
+var MAX_PIPELINED = 16
+
+// How much of a body left unread by its handler is discarded to keep the connection alive
+var MAX_BODY_DRAIN int64 = 256 * 1024
+
+// Largest accepted upload in bytes, 0 means no limit
+var MAX_UPLOAD_SIZE int64
+
+// Set by --create-dirs, lets uploads create missing directories below DIRPATH
+var CREATE_DIRS bool
+
+// logError reports an error without stopping the server
+func logError(msg string, err error) {
+	fmt.Printf("Encountered error:\n%s\n%v\n", msg, err)
+}
+
+// logPanic reports a recovered panic along with the stack of the panicking goroutine
+func logPanic(context string, recovered interface{}) {
+	stack := make([]byte, 64*1024)
+	stack = stack[:runtime.Stack(stack, false)]
+	logError(context, fmt.Errorf("panic: %v\n%s", recovered, stack))
+}
+
+// handleError reports an error the server can't start up with and exits
 func handleError(msg string, err error) {
-	fmt.Printf("Encountered error:\n%s\n%v", msg, err)
+	logError(msg, err)
 	os.Exit(1)
 }
 
@@ -39,6 +70,29 @@ func define_flags() {
 	// Get flags from command line
 	debugger := flag.Bool("debugger", false, "turn debugging on")
 	directory := flag.String("directory", "", "directory location")
+	createDirs := flag.Bool("create-dirs", false, "create missing directories for uploads inside --directory")
+	maxUploadSize := flag.Int64("max-upload-size", 0, "maximum upload size in bytes, 0 for no limit")
+	etagMode := flag.String("etag", "strong", "entity tags for served files: strong or weak")
+	followSymlinks := flag.Bool("follow-external-symlinks", false, "allow symlinks in --directory to point outside of it")
+	strict := flag.Bool("strict", false, "reject requests that don't follow RFC 9112 to the letter")
+	maxRequestLine := flag.Int("max-request-line", MAX_REQUEST_LINE, "maximum request line length in bytes")
+	maxHeaderBytes := flag.Int("max-header-bytes", MAX_HEADER_BYTES, "maximum size of all request headers in bytes")
+	maxHeaderCount := flag.Int("max-header-count", MAX_HEADER_COUNT, "maximum number of request headers")
+	maxBodySize := flag.Int64("max-body-size", 0, "maximum request body size in bytes, 0 for no limit")
+	readHeaderTimeout := flag.Duration("read-header-timeout", READ_HEADER_TIMEOUT, "time allowed to send the request line and headers, 0 for no limit")
+	readTimeout := flag.Duration("read-timeout", READ_TIMEOUT, "time each read of a request body may stall, 0 for no limit")
+	writeTimeout := flag.Duration("write-timeout", WRITE_TIMEOUT, "time each write of a response may stall, 0 for no limit")
+	shutdownTimeout := flag.Duration("shutdown-timeout", SHUTDOWN_TIMEOUT, "time active connections get to finish on SIGINT or SIGTERM, 0 for no limit")
+	port := flag.Int("port", PORT, "port for --addr values that don't include one")
+	flag.Var((*stringList)(&LISTEN_ADDRS), "addr", "address to listen on: host, host:port, [ipv6]:port or unix:/path, repeat or comma separate for several (default "+DEFAULT_LISTEN_ADDR+")")
+	flag.Var((*stringList)(&TLS_CERT_FILES), "tls-cert", "certificate file for HTTPS, repeat with --tls-key for more hostnames")
+	flag.Var((*stringList)(&TLS_KEY_FILES), "tls-key", "private key file for the --tls-cert in the same position")
+	tlsClientCA := flag.String("tls-client-ca", "", "CA bundle to verify client certificates against, enables mutual TLS")
+	tlsClientAuth := flag.String("tls-client-auth", TLS_CLIENT_AUTH, "client certificates: optional lets routes decide, require refuses clients without one")
+	flag.Var((*stringList)(&REDIRECT_ADDRS), "redirect-addr", "plaintext address that redirects to HTTPS, port 80 unless given, repeat or comma separate for several")
+	flag.Var((*stringList)(&REDIRECT_EXEMPT), "redirect-exempt", "route pattern served on --redirect-addr instead of redirecting, it must match a route of the server, e.g. \"GET /files/{path...}\"")
+	tlsReloadInterval := flag.Duration("tls-reload-interval", TLS_RELOAD_INTERVAL, "how often certificate files are checked for changes, 0 to never reload")
+	idleTimeout := flag.Duration("idle-timeout", IDLE_TIMEOUT, "time a keep-alive connection may wait for its next request, 0 for no limit")
 	flag.Parse()
 	if *debugger == true {
 		DEBUGGER = true
@@ -59,6 +113,59 @@ func define_flags() {
 	}
 	debugf("--directory: %s found: %v", DIRPATH, pathExists(DIRPATH))
 
+	MAX_UPLOAD_SIZE = *maxUploadSize
+	debugf("--max-upload-size: %d", MAX_UPLOAD_SIZE)
+
+	CREATE_DIRS = *createDirs
+	debugf("--create-dirs: %v", CREATE_DIRS)
+
+	if *etagMode != "strong" && *etagMode != "weak" {
+		handleError("Invalid --etag value", fmt.Errorf("Expected strong or weak, received: %s", *etagMode))
+	}
+	ETAG_MODE = *etagMode
+	debugf("--etag: %s", ETAG_MODE)
+
+	FOLLOW_EXTERNAL_SYMLINKS = *followSymlinks
+	debugf("--follow-external-symlinks: %v", FOLLOW_EXTERNAL_SYMLINKS)
+
+	STRICT_PARSING = *strict
+	debugf("--strict: %v", STRICT_PARSING)
+
+	MAX_REQUEST_LINE = *maxRequestLine
+	MAX_HEADER_BYTES = *maxHeaderBytes
+	MAX_HEADER_COUNT = *maxHeaderCount
+	MAX_BODY_SIZE = *maxBodySize
+	debugf("--max-request-line: %d --max-header-bytes: %d --max-header-count: %d --max-body-size: %d",
+		MAX_REQUEST_LINE, MAX_HEADER_BYTES, MAX_HEADER_COUNT, MAX_BODY_SIZE)
+
+	READ_HEADER_TIMEOUT = *readHeaderTimeout
+	READ_TIMEOUT = *readTimeout
+	WRITE_TIMEOUT = *writeTimeout
+	IDLE_TIMEOUT = *idleTimeout
+	debugf("--read-header-timeout: %v --read-timeout: %v --write-timeout: %v --idle-timeout: %v",
+		READ_HEADER_TIMEOUT, READ_TIMEOUT, WRITE_TIMEOUT, IDLE_TIMEOUT)
+
+	PORT = *port
+	debugf("--port: %d --addr: %v", PORT, LISTEN_ADDRS)
+
+	SHUTDOWN_TIMEOUT = *shutdownTimeout
+	debugf("--shutdown-timeout: %v", SHUTDOWN_TIMEOUT)
+
+	TLS_RELOAD_INTERVAL = *tlsReloadInterval
+	debugf("--tls-cert: %v --tls-key: %v --tls-reload-interval: %v", TLS_CERT_FILES, TLS_KEY_FILES, TLS_RELOAD_INTERVAL)
+
+	TLS_CLIENT_CA = *tlsClientCA
+	TLS_CLIENT_AUTH = *tlsClientAuth
+	if len(TLS_CLIENT_CA) > 0 && !tlsEnabled() {
+		handleError("Invalid --tls-client-ca", fmt.Errorf("Client certificates need HTTPS, set --tls-cert and --tls-key"))
+	}
+	debugf("--tls-client-ca: %s --tls-client-auth: %s", TLS_CLIENT_CA, TLS_CLIENT_AUTH)
+
+	if len(REDIRECT_ADDRS) > 0 && !tlsEnabled() {
+		handleError("Invalid --redirect-addr", fmt.Errorf("Redirects to HTTPS need --tls-cert and --tls-key"))
+	}
+	debugf("--redirect-addr: %v --redirect-exempt: %v", REDIRECT_ADDRS, REDIRECT_EXEMPT)
+
 }
 
 func debug(msg string) {
@@ -74,91 +181,53 @@ func debugf(msgformat string, args ...interface{}) {
 
 // http Helpers
 
-func routePatternIsFound(pattern string) bool {
-	_, ok := routes[pattern]
-	if ok {
-		debugf("Route pattern found: %s", pattern)
-		return true
-	} else {
-		debugf("Route not found: %s", pattern)
-		return false
+// routeRequest runs the handler of the route matching req
+func routeRequest(conn net.Conn, req Http_Request) Http_Response {
+	entry, params := router.Match(req.Method, req.Target)
+	if entry == nil {
+		allowed := router.Allowed(req.Target)
+		if len(allowed) == 0 {
+			debug("No matching route patterns found!")
+			return textResponse(404, "")
+		}
+		// OPTIONS is always answered, from the route table when no route handles it
+		if !slices.Contains(allowed, "OPTIONS") {
+			allowed = append(allowed, "OPTIONS")
+			sort.Strings(allowed)
+		}
+		allow := strings.Join(allowed, ", ")
+		if req.Method == "OPTIONS" {
+			debugf("Answering OPTIONS for %s: %s", req.Target, allow)
+			res := newResponse(204)
+			res.Headers.Set("Allow", allow)
+			return res
+		}
+		debugf("Method %s not allowed for %s, allowed: %s", req.Method, req.Target, allow)
+		res := textResponse(405, "")
+		res.Headers.Set("Allow", allow)
+		return res
 	}
+	if refused := checkRoutePolicy(entry, req); refused != nil {
+		return *refused
+	}
+	debugf("Executing handler for route: %s", entry.pattern)
+	return entry.handler(params, conn, req)
 }
-func tryRouteHandler(pattern string, value string, conn net.Conn, req Http_Request) (Http_Response, error) {
-	debugf("Trying handler for route: %s", pattern)
-	if handler, exists := routes[pattern]; exists {
-		debug("Found route handler, executing...")
-		response := handler(value, conn, req)
-		return response, nil
-	} else {
-		debug("Could not find handler!")
-		return Http_Response{}, fmt.Errorf("No handler found for route pattern: %v", pattern)
-	}
-}
-
-func checkRoutePatterns(conn net.Conn, req Http_Request) Http_Response {
-	method := req.Method
-	target := req.Target
-	tpath := strings.Clone(target)
-
-	debug("Checking Route Patterns in 'exactness' priority order...\n")
-
-	segs := strings.Split(tpath, "/")
-	segCount := len(segs)
-	lastIndex := strings.LastIndex(tpath, "/")
-	lastPath := ""
-	if lastIndex != -1 && lastIndex < len(tpath)-1 {
-		lastPath = tpath[lastIndex+1:]
-	}
-	debugf("Last Index: %d", lastIndex)
-	debugf("Last Path: %s", lastPath)
-	debugf("Segments: %d", segCount)
-
-	routeFound := false
-	for i, seg := range segs {
-		placeHolder := strings.Repeat("/{str}", i+1)
-		debugf("Current seg: %s Current i: %d Current vtest: %s\r\n", seg, i, placeHolder)
-		if i == 0 {
-			searchPath := fmt.Sprintf("%s %s", method, tpath)
-			routeFound = routePatternIsFound(searchPath)
-			if routeFound {
-				debugf("exact path found: %s", searchPath)
-				response, err := tryRouteHandler(searchPath, "", conn, req)
-				if err != nil {
-					handleError("Error in trying to execute handler", err)
-				}
-				return response
-			}
-		}
 
-		/* If no exact path is found, try alternates with {str} placeholders
-		substitue path elements right to left and replace with {str} for each variation */
-
-		debug("No exact path match found... checking alternate routes")
-		idx := strings.LastIndex(tpath, "/")
-		if !routeFound && idx != -1 && idx < len(tpath) {
-			leftPath := tpath[:idx]
-			value := target[idx+1:]
-			nextSearch := fmt.Sprintf("%s %s%s", method, leftPath, placeHolder)
-			debugf("\r\nChecking route: %s with value: %s\r\n", nextSearch, value)
-			routeFound = routePatternIsFound(nextSearch)
-			if routeFound {
-				debugf("alternate path found: %s", nextSearch)
-				response, err := tryRouteHandler(nextSearch, value, conn, req)
-				if err != nil {
-					handleError("Error in trying to execute handler", err)
-				}
-				return response
-			}
-			tpath = leftPath
+// HTTP_TIME_FORMAT is the IMF-fixdate format used for dates in HTTP headers
+const HTTP_TIME_FORMAT = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// parseHTTPDate accepts IMF-fixdate plus the obsolete RFC 850 and asctime formats
+func parseHTTPDate(value string) (time.Time, error) {
+	var err error
+	for _, layout := range []string{HTTP_TIME_FORMAT, time.RFC850, time.ANSIC} {
+		var date time.Time
+		date, err = time.Parse(layout, strings.TrimSpace(value))
+		if err == nil {
+			return date.UTC(), nil
 		}
-
 	}
-	// No patterns found
-	if !routeFound {
-		debug("No matching route patterns found!")
-	}
-	return NOT_FOUND
+	return time.Time{}, err
 }
 
 func stringByteLenAsString(s string) string {
@@ -169,29 +238,36 @@ func stringByteLenAsString(s string) string {
 	return fmt.Sprintf("Content-Length: %s\r\n", valueStr)
 }
 
-func headersMapToString(headers map[string]string) string {
+func headersMapToString(headers Http_Header) string {
 	headerString := ""
 	if len(headers) == 0 {
 		return CRLF
 	}
-	for key, value := range headers {
-		headerString += fmt.Sprintf("%s: %s\r\n", key, value)
+	for _, key := range headers.Keys() {
+		// Fields with several values go out on several lines, Set-Cookie can't be combined
+		for _, value := range headers[key] {
+			headerString += fmt.Sprintf("%s: %s\r\n", key, value)
+		}
 	}
 	return headerString
 }
 
-func headersStringToMap(headers string) map[string]string {
-	headersMap := make(map[string]string)
-	headerLines := strings.Split(headers, CRLF)
+func headersStringToMap(headers string) Http_Header {
+	headersMap := make(Http_Header)
+	headerLines := strings.Split(headers, "\n")
 	for i := 0; i < len(headerLines); i++ {
-		keyValuePair := strings.Split(headerLines[i], ": ")
-		if len(keyValuePair) != 2 {
-			headersMap[headerLines[i]] = ""
-		} else {
-			key := keyValuePair[0]
-			value := keyValuePair[1]
-			headersMap[key] = value
+		line := strings.TrimSuffix(headerLines[i], "\r")
+		if len(line) == 0 {
+			continue
 		}
+		key, value, found := strings.Cut(line, ":")
+		key = strings.TrimSpace(key)
+		if !found || len(key) == 0 {
+			debugf("Ignoring malformed header line: %q", line)
+			continue
+		}
+		// Optional whitespace around the value isn't part of it
+		headersMap.Add(key, strings.TrimSpace(value))
 	}
 	return headersMap
 }
@@ -223,21 +299,46 @@ type Http_Request struct {
 	Method  string
 	Target  string
 	Version string
-	Headers map[string]string
-	Body    string
+	Headers Http_Header
+	// Body streams the request content straight from the connection. Trailers
+	// of a chunked body are only filled in once Body has been read to the end.
+	Body     io.Reader
+	Trailers Http_Header
+	// ClientSubject is the subject of the verified client certificate, "" when
+	// the client didn't authenticate with one
+	ClientSubject string
 }
 
 type Http_Response struct {
 	Version string
 	Status  int
 	Reason  string
-	Headers map[string]string
+	Headers Http_Header
 	Body    string
+	// Streaming bodies replace Body when set. Without a Content-Length header
+	// they are sent using chunked transfer coding, followed by any Trailers.
+	BodyReader io.Reader
+	BodyWriter func(io.Writer) error
+	Trailers   Http_Header
+}
+
+// Http_Error is returned while reading a request when the client should get
+// an error response and the connection should be closed.
+type Http_Error struct {
+	Status int
+	Msg    string
+}
+
+func newHttpError(status int, msg string) *Http_Error {
+	return &Http_Error{Status: status, Msg: msg}
+}
+
+func (e *Http_Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, statusReason(e.Status), e.Msg)
 }
 
-type Route_Handler struct {
-	Match   *regexp.Regexp
-	Handler func(Http_Request) Http_Response
+func (e *Http_Error) Response() Http_Response {
+	return textResponse(e.Status, e.Msg)
 }
 
 const (
@@ -246,109 +347,238 @@ const (
 	DoubleCRLF = CRLF + CRLF
 )
 
-var OK = Http_Response{
-	Version: HTTPV,
-	Status:  200,
-	Reason:  "OK",
-	Headers: make(map[string]string),
-	Body:    "" + CRLF,
-}
+// Request Handlers
 
-var NOT_FOUND = Http_Response{
-	Version: HTTPV,
-	Status:  404,
-	Reason:  "Not Found",
-	Headers: map[string]string{"Content-Type": "text/plain"},
-	Body:    "",
+func handleRequests(conn net.Conn, req Http_Request) (res Http_Response) {
+	defer func() {
+		// A panicking handler only fails its own request
+		if recovered := recover(); recovered != nil {
+			logPanic(fmt.Sprintf("Handler panicked for \"%s %s %s\" from %s", req.Method, req.Target, req.Version, conn.RemoteAddr()), recovered)
+			res = textResponse(500, "")
+		}
+	}()
+	debug("Handling a new connection request...")
+	if shouldRedirect(conn, req) {
+		return httpsRedirect(req)
+	}
+	debug("Building route search map...")
+	res = routeRequest(conn, req)
+	debug("Returning response for the pipeline writer")
+	return res
 }
 
-var BAD_REQUEST = Http_Response{
-	Version: HTTPV,
-	Status:  400,
-	Reason:  "Bad Request",
-	Headers: map[string]string{"Content-Type": "text/plain"},
-	Body:    "",
+// keepAliveRequested decides if the connection stays open after answering req.
+// HTTP/1.1 connections are persistent unless the client sends "Connection: close",
+// HTTP/1.0 connections are closed unless the client sends "Connection: keep-alive".
+func keepAliveRequested(req Http_Request) bool {
+	keepAlive := req.Version == HTTPV
+	for _, token := range headerTokens(req.Headers, "Connection") {
+		switch token {
+		case "close":
+			return false
+		case "keep-alive":
+			keepAlive = true
+		}
+	}
+	debugf("Version: %s keep-alive: %v", req.Version, keepAlive)
+	return keepAlive
 }
 
-var SERVER_ERROR = Http_Response{
-	Version: HTTPV,
-	Status:  500,
-	Reason:  "Internal Server Error",
-	Headers: map[string]string{"Content-Type": "text/plain"},
-	Body:    "",
-}
+// Response Handlers
 
-// Request Handlers
+// fileBody streams exactly the stat'ed size of an open file and closes it when done.
+// Handing the embedded *io.LimitedReader over *os.File to a TCP connection lets
+// the kernel send the file with sendfile.
+type fileBody struct {
+	io.LimitedReader
+	file *os.File
+}
 
-func handleRequests(conn net.Conn, req Http_Request) {
-	debug("Handling a new connection request...")
-	debug("Building route search map...")
-	res := checkRoutePatterns(conn, req)
-	debug("Sending response to responseWriter")
-	responseWriter(conn, res)
+func (f *fileBody) Close() error {
+	return f.file.Close()
 }
 
-// Response Handlers
-func fileResponseBody(dataPath string, res *Http_Response) (string, error) {
+// fileResponseBody sets res up to stream the file at dataPath, or the ranges of
+// it asked for by req. On failure the status and body of res describe the error.
+func fileResponseBody(dataPath string, req Http_Request, res *Http_Response) error {
 	debugf("Creating body from file: %s", dataPath)
-	debugf("Calling Handler: %s", res.Headers["Request-Handler"])
+	debugf("Calling Handler: %s", res.Headers.Get("Request-Handler"))
 
 	file, err := os.Open(dataPath)
 	if err != nil {
-		res.Status = 404
-		res.Reason = "Not Found"
-		return "Unable to open resource.", err
+		setStatus(res, 404)
+		res.Body = "Unable to open resource."
+		return err
 	}
-	defer file.Close()
 
 	fileInfo, err := file.Stat()
 	if err != nil {
-		res.Status = 500
-		res.Reason = "Internal Server Error"
-		return "Unable to get file information.", err
+		file.Close()
+		setStatus(res, 500)
+		res.Body = "Unable to get file information."
+		return err
 	}
 	debugf("file.Stat() call returns: %v", fileInfo)
+	if fileInfo.IsDir() {
+		// Directories aren't served, only the files inside them
+		file.Close()
+		setStatus(res, 404)
+		res.Body = "Resource is a directory."
+		return fmt.Errorf("Requested path is a directory: %s", dataPath)
+	}
 
 	fileSize := fileInfo.Size()
 	debugf("fileInfo.Size() reports: %d", fileSize)
 	contentLength := fmt.Sprintf("%d", fileSize)
-	res.Headers["Content-Length"] = contentLength
-	debugf("Content-Length header set to: %s", res.Headers["Content-Length"])
-
-	//reader := bufio.NewReaderSize(file, 1024)
-	body := make([]byte, fileSize)
-	//	n, err := reader.Read(body)
-	debug("Staring file.Read()")
-	n, err := file.Read(body)
+	res.Headers.Set("Content-Length", contentLength)
+	debugf("Content-Length header set to: %s", res.Headers.Get("Content-Length"))
+
+	setValidators(res, fileInfo)
+	if req.Method == "GET" && notModified(req, fileInfo) {
+		debug("File not modified, sending 304")
+		file.Close()
+		setStatus(res, 304)
+		res.Headers.Del("Content-Length")
+		return nil
+	}
+
+	debug("File will be streamed by responseWriter")
+	res.BodyReader = &fileBody{LimitedReader: io.LimitedReader{R: file, N: fileSize}, file: file}
+
+	err = applyRanges(req, res, file, fileInfo)
 	if err != nil {
-		res.Status = 500
-		res.Reason = "Internal Server Error"
-		return "Unable to read file.", err
+		file.Close()
+		res.BodyReader = nil
+		setStatus(res, 500)
+		res.Body = "Unable to read requested range."
+		res.Headers.Del("Content-Length")
+		return err
+	}
+	return nil
+}
+
+// streamBody copies a streaming response body to w, closing its reader when done
+func streamBody(res Http_Response, w io.Writer) error {
+	if res.BodyWriter != nil {
+		return res.BodyWriter(w)
 	}
-	if int64(n) != fileSize {
-		res.Status = 500
-		res.Reason = "Internal Server Error"
-		return "Mismatch in file size and read bytes.", fmt.Errorf("Read %d bytes, expected %d", n, fileSize)
+	if closer, ok := res.BodyReader.(io.Closer); ok {
+		defer closer.Close()
+	}
+	if body, ok := res.BodyReader.(*fileBody); ok {
+		// Copy segments from the bare file so the connection can use sendfile,
+		// a deadline writer gives each segment its own write deadline
+		var n int64
+		var err error
+		for body.N > 0 && err == nil {
+			segment := &io.LimitedReader{R: body.file, N: min(body.N, WRITE_SEGMENT_SIZE)}
+			var copied int64
+			copied, err = io.Copy(w, segment)
+			body.N -= copied
+			n += copied
+			if err == nil && segment.N > 0 {
+				// The file ended early
+				break
+			}
+		}
+		debugf("Streamed %d bytes from file", n)
+		if err == nil && body.N > 0 {
+			err = fmt.Errorf("File shrank while streaming, %d bytes missing", body.N)
+		}
+		return err
+	}
+	_, err := io.Copy(w, res.BodyReader)
+	return err
+}
+
+// discardBody releases the streaming body of a response that won't be sent
+func discardBody(res Http_Response) {
+	if closer, ok := res.BodyReader.(io.Closer); ok {
+		closer.Close()
 	}
-	debugf("Expected %v bytes, Read %d bytes.", fileSize, n)
-	return string(body), nil
 }
 
-func responseWriter(conn net.Conn, res Http_Response) {
+func isStreaming(res Http_Response) bool {
+	return res.BodyReader != nil || res.BodyWriter != nil
+}
+
+// responseWriter sends res as the answer to req and reports if the connection
+// can stay open for the next response.
+func responseWriter(conn net.Conn, req Http_Request, res Http_Response, keepAlive bool) bool {
 	debug("Sending connection response...")
+	// Copy headers so connection specific values never leak into shared responses
+	headers := res.Headers.Clone()
+	streaming := isStreaming(res)
+	chunked := false
+	// 1xx, 204 and 304 responses never have a body
+	bodyless := res.Status < 200 || res.Status == 204 || res.Status == 304
+	if !headers.Has("Content-Length") && !bodyless {
+		if !streaming {
+			// Persistent connections rely on Content-Length to find the end of the body
+			headers.Set("Content-Length", strconv.Itoa(len(res.Body)))
+		} else if req.Version == HTTPV {
+			debug("Streaming body of unknown length, using chunked transfer coding")
+			chunked = true
+			headers.Set("Transfer-Encoding", "chunked")
+			if len(res.Trailers) > 0 {
+				headers.Set("Trailer", strings.Join(res.Trailers.Keys(), ", "))
+			}
+		} else {
+			// HTTP/1.0 clients can't decode chunks, the body ends when the connection closes
+			debug("Streaming body of unknown length to HTTP/1.0 client, closing after body")
+			keepAlive = false
+		}
+	}
+	if keepAlive {
+		headers.Set("Connection", "keep-alive")
+		if IDLE_TIMEOUT > 0 {
+			headers.Set("Keep-Alive", fmt.Sprintf("timeout=%d", int(IDLE_TIMEOUT.Seconds())))
+		}
+	} else {
+		headers.Set("Connection", "close")
+	}
+	res.Headers = headers
 	response := buildResponseString(res)
 	debug("String returned from buildResponseString()")
 	debug("---------")
 	debug(response)
 	debug("---------")
-	writer := bufio.NewWriter(conn)
+	// Every write to the client gets WRITE_TIMEOUT to make progress
+	out := &deadlineWriter{conn: conn}
+	writer := bufio.NewWriter(out)
 	writeResult, err := writer.WriteString(response)
 	debugf("writeResult: %v", writeResult)
 	if err != nil {
-		handleError("Unable to write response", err)
+		// Most likely the client went away, the connection is done either way
+		logError("Unable to write response", err)
+		discardBody(res)
+		return false
+	}
+
+	if streaming {
+		debug("Streaming response body...")
+		if chunked {
+			chunkWriter := newChunkedBodyWriter(writer)
+			err = streamBody(res, chunkWriter)
+			if err == nil {
+				err = chunkWriter.finish(res.Trailers)
+			}
+		} else {
+			// Headers go out first so the body can be copied straight to the connection
+			err = writer.Flush()
+			if err == nil {
+				err = streamBody(res, out)
+			}
+		}
+		if err != nil {
+			// The status line is already sent, all we can do is cut the body short
+			debugf("Error streaming response body, closing connection: %v", err)
+			return false
+		}
 	}
 	writer.Flush()
 	debugf("Sent response: %s", response)
+	return keepAlive
 }
 
 // Encoding Handlers
@@ -357,16 +587,24 @@ var encoders = make(map[string]func(*Http_Response) error)
 func checkEncodingOptions(req *Http_Request, res *Http_Response) {
 	debug("Checking encoding options")
 	// Check if request accepts encoding:
-	_, encoding := req.Headers["Accept-Encoding"]
+	encoding := req.Headers.Has("Accept-Encoding")
 	if encoding {
-		// Check for multiple encoding options
-		opts := strings.Split(req.Headers["Accept-Encoding"], ",")
+		// Check for multiple encoding options, across every Accept-Encoding line
+		opts := headerTokens(req.Headers, "Accept-Encoding")
 		for _, opt := range opts {
-			if encoder, exists := encoders[strings.TrimSpace(opt)]; exists {
+			// Parameters such as ";q=0.8" follow the coding, q=0 means not acceptable
+			opt, params, _ := strings.Cut(opt, ";")
+			opt = strings.TrimSpace(opt)
+			if qualityValue(params) == 0 {
+				debugf("Client refuses encoding: %s", opt)
+				continue
+			}
+			if encoder, exists := encoders[opt]; exists {
 				debugf("Found encoder for type: %s", opt)
 				err := encoder(res)
 				if err != nil {
-					handleError("Problem with encoder", err)
+					// Encoders leave res untouched on failure, so send it unencoded
+					logError("Problem with encoder, sending identity encoding", err)
 				}
 				return
 			} else {
@@ -374,7 +612,7 @@ func checkEncodingOptions(req *Http_Request, res *Http_Response) {
 			}
 		}
 	}
-	debugf("No valid encoder found for: %s", req.Headers["Accept-Encoding"])
+	debugf("No valid encoder found for: %v", req.Headers.Values("Accept-Encoding"))
 	return
 }
 
@@ -388,66 +626,80 @@ func define_encoders() {
 
 func gzipCompressor(res *Http_Response) error {
 	debug("Using gzipCompressor")
+	if isStreaming(*res) {
+		// Compress on the fly, the compressed length is unknown until the end
+		debug("Compressing streaming body")
+		source := *res
+		res.BodyReader = nil
+		res.BodyWriter = func(w io.Writer) error {
+			gzipWriter := gzip.NewWriter(w)
+			if err := streamBody(source, gzipWriter); err != nil {
+				return err
+			}
+			return gzipWriter.Close()
+		}
+		res.Headers.Del("Content-Length")
+		res.Headers.Set("Content-Encoding", "gzip")
+		return nil
+	}
 	var buf bytes.Buffer
 	uncompressedBytes := len(res.Body)
 
 	gzipWriter := gzip.NewWriter(&buf)
 	_, err := gzipWriter.Write([]byte(res.Body))
 	if err != nil {
-		handleError("Problem with gzip encoder", err)
-		return err
+		return fmt.Errorf("Problem with gzip encoder: %v", err)
 	}
 
 	err = gzipWriter.Close()
 	if err != nil {
-		handleError("Problem closing gzip encoder", err)
-		return err
+		return fmt.Errorf("Problem closing gzip encoder: %v", err)
 	}
 
 	res.Body = buf.String()
 	contentLength := len(res.Body)
-	res.Headers["Content-Encoding"] = "gzip"
-	res.Headers["Content-Length"] = strconv.Itoa(contentLength)
+	res.Headers.Set("Content-Encoding", "gzip")
+	res.Headers.Set("Content-Length", strconv.Itoa(contentLength))
 	debugf("original bytes: %d, gzip bytes: %d", uncompressedBytes, contentLength)
 	return nil
 }
 
 // Route Handlers
-var routesMutex sync.Mutex
-var routes = make(map[string]func(string, net.Conn, Http_Request) Http_Response)
+var router = newRouter()
 
-func rootHandler(pathVals string, conn net.Conn, req Http_Request) Http_Response {
+func rootHandler(params map[string]string, conn net.Conn, req Http_Request) Http_Response {
 	res := Http_Response{
 		Version: HTTPV,
 		Status:  200,
 		Reason:  "OK",
-		Headers: map[string]string{"Content-Type": "text/plain"},
+		Headers: Http_Header{"Content-Type": {"text/plain"}},
 		Body:    CRLF,
 	}
 	return res
 }
 
-func echoHandler(pathVals string, conn net.Conn, req Http_Request) Http_Response {
+func echoHandler(params map[string]string, conn net.Conn, req Http_Request) Http_Response {
+	echo := params["str"]
 	contentLength := "0"
-	if len(pathVals) > 0 {
-		contentLength = strconv.Itoa(len(pathVals))
+	if len(echo) > 0 {
+		contentLength = strconv.Itoa(len(echo))
 	}
 	res := Http_Response{
 		Version: HTTPV,
 		Status:  200,
 		Reason:  "OK",
-		Headers: map[string]string{"Content-Type": "text/plain", "Content-Length": contentLength},
-		Body:    pathVals,
+		Headers: Http_Header{"Content-Type": {"text/plain"}, "Content-Length": {contentLength}},
+		Body:    echo,
 	}
 
 	checkEncodingOptions(&req, &res)
 	/*
 		// Check if request accepts compression
-		_, encoding := req.Headers["Accept-Encoding"]
+		encoding := req.Headers.Has("Accept-Encoding")
 		if encoding {
-			debugf("Accept-Encoding header: %s", req.Headers["Accept-Encoding"])
+			debugf("Accept-Encoding header: %s", req.Headers.Get("Accept-Encoding"))
 			// Check if accepted encoding option is available
-			encodeType := req.Headers["Accept-Encoding"]
+			encodeType := req.Headers.Get("Accept-Encoding")
 			debugf("ecodeType set to: %s", encodeType)
 			if encoder, exists := encoders[encodeType]; exists {
 				debug("Found encoder.")
@@ -463,9 +715,9 @@ func echoHandler(pathVals string, conn net.Conn, req Http_Request) Http_Response
 	return res
 }
 
-func userAgentHandler(pathVals string, conn net.Conn, req Http_Request) Http_Response {
+func userAgentHandler(params map[string]string, conn net.Conn, req Http_Request) Http_Response {
 	contentLength := "0"
-	body := req.Headers["User-Agent"]
+	body := req.Headers.Get("User-Agent")
 	if len(body) > 0 {
 		contentLength = strconv.Itoa(len(body))
 	}
@@ -474,275 +726,629 @@ func userAgentHandler(pathVals string, conn net.Conn, req Http_Request) Http_Res
 		Version: HTTPV,
 		Status:  200,
 		Reason:  "OK",
-		Headers: map[string]string{"Content-Type": "text/plain", "Content-Length": contentLength},
+		Headers: Http_Header{"Content-Type": {"text/plain"}, "Content-Length": {contentLength}},
 		Body:    body,
 	}
 	return res
 }
 
-func fileRequestHandler(pathVals string, conn net.Conn, req Http_Request) Http_Response {
+func fileRequestHandler(params map[string]string, conn net.Conn, req Http_Request) Http_Response {
 	// Set initial res values, presume not found
 	res := Http_Response{
 		//TODO Set these values, so that filebody can work
 		Version: HTTPV,
 		Status:  404,
 		Reason:  "Not Found",
-		Headers: map[string]string{"Content-Type": "application/octet-stream"},
+		Headers: Http_Header{"Content-Type": {"application/octet-stream"}},
 		Body:    "",
 	}
 
-	// Set filename from pathVals
-	filename := pathVals
-	debugf("filename: %s", filename)
-	res.Headers["Content-Disposition"] = fmt.Sprintf("attachment; filename=%s", filename)
-
-	// Set directory path
-	dirPathExists := pathExists(DIRPATH)
-	if !dirPathExists {
-		debugf("Could not find dir path: %s", DIRPATH)
+	// Map the file path to a file inside the served directory
+	fullpath, err := sandboxPath(params["path"])
+	if err != nil {
+		var httpErr *Http_Error
+		errors.As(err, &httpErr)
+		debugf("Refusing file request: %v", err)
+		return httpErr.Response()
 	}
-
-	// Set Full Path
-	fullpath := DIRPATH + filename
 	debugf("fullpath: %s", fullpath)
 
+	filename := filepath.Base(fullpath)
+	debugf("filename: %s", filename)
+
 	// Check for filepath and update response values
 	filePathExists := pathExists(fullpath)
 	if !filePathExists {
 		debug("Path to file DOES NOT exist!")
-		res.Status = 404
-		res.Reason = "Not Found"
-		res.Body = fmt.Sprintf("File path not found: %s", fullpath)
+		setStatus(&res, 404)
+		res.Body = fmt.Sprintf("File not found: %s", filename)
 		return res
 	}
 
 	debug("Path to file exists!")
-	res.Status = 200
-	res.Reason = "OK"
-	res.Headers["Request-Handler"] = "file-request-handler"
+	setStatus(&res, 200)
+	// Quoted or RFC 2231 encoded as needed, the name came from the client
+	if disposition := mime.FormatMediaType("attachment", map[string]string{"filename": filename}); len(disposition) > 0 {
+		res.Headers.Set("Content-Disposition", disposition)
+	}
+	res.Headers.Set("Request-Handler", "file-request-handler")
 
 	debug("Attempting to load body from file...")
-	body, err := fileResponseBody(fullpath, &res)
+	err = fileResponseBody(fullpath, req, &res)
 	if err != nil {
-		handleError("File not found!", err)
+		// fileResponseBody already set the error status and body
+		logError("Unable to serve file", err)
 		return res
 	}
-	res.Body = body
 
 	return res
 }
 
-// return an http-style status int (e.g,. 201,400,500) status message string, and error status
-func uploadHandler(fileLength int64, filename string, content string) (int, string, error) {
-	var status int
-	var reason string
-	var errMsg error
+// bodyReadErrorStatus picks the status for a request body that couldn't be read
+func bodyReadErrorStatus(err error) int {
+	var httpErr *Http_Error
+	if errors.As(err, &httpErr) {
+		return httpErr.Status
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return 408
+	}
+	return 400
+}
 
-	//TODO
-	// Open file path for writing
-	filePath := DIRPATH + filename
-	debugf("Attempting to upload to filepath: %s", filePath)
-	destFile, err := os.Create(filePath)
+// syncDir flushes directory entries, making a rename into dir durable
+func syncDir(dir string) {
+	dirFile, err := os.Open(dir)
 	if err != nil {
-		status = 500
-		reason = "Internal Server Error"
-		errMsg = fmt.Errorf("Unable to create filepath: %s", filePath)
-		return status, reason, errMsg
-	}
-	defer destFile.Close()
-
-	// Commented out, trying to write waht is passed in via content
-	// Create buffer reader for content
-	debug("Reading request body content...")
-	reader := strings.NewReader(content)
-
-	// Begin writing to file
-	debug("Establishing server writer...")
-	bufWriter := bufio.NewWriter(destFile)
-	buf := make([]byte, 1024)
-	remaining := int64(fileLength)
-	for remaining > 0 {
-		readSize := 1024
-		if remaining < int64(readSize) {
-			readSize = int(remaining)
-		}
-		n, err := reader.Read(buf[:readSize])
-		if err != nil {
-			debug("Error reading file!")
-			status = 500
-			reason = "Internal Server Error"
-			errMsg = fmt.Errorf("Unable to read from connection buffer.")
-			return status, reason, errMsg
+		debugf("Unable to open directory for sync: %v", err)
+		return
+	}
+	defer dirFile.Close()
+	if err := dirFile.Sync(); err != nil {
+		debugf("Unable to sync directory: %v", err)
+	}
+}
+
+// uploadDirReady makes sure the directory an upload goes into exists, creating
+// it and its parents when CREATE_DIRS allows. Otherwise a missing directory is
+// a 409 Conflict, as is a parent that is a file.
+func uploadDirReady(uploadDir string) (int, error) {
+	fileInfo, err := os.Stat(uploadDir)
+	if err == nil {
+		if !fileInfo.IsDir() {
+			return 409, fmt.Errorf("Upload parent is not a directory: %s", uploadDir)
 		}
+		return 0, nil
+	}
+	if errors.Is(err, syscall.ENOTDIR) {
+		return 409, fmt.Errorf("Upload parent is not a directory: %s", uploadDir)
+	}
+	if !os.IsNotExist(err) {
+		return 500, fmt.Errorf("Unable to check upload directory: %v", err)
+	}
+	if !CREATE_DIRS {
+		return 409, fmt.Errorf("Upload directory does not exist: %s", uploadDir)
+	}
+	debugf("Creating upload directory: %s", uploadDir)
+	if err := os.MkdirAll(uploadDir, 0755); err != nil {
+		if errors.Is(err, syscall.ENOTDIR) {
+			return 409, fmt.Errorf("Upload parent is not a directory: %s", uploadDir)
+		}
+		return 500, fmt.Errorf("Unable to create upload directory: %v", err)
+	}
+	syncDir(filepath.Dir(uploadDir))
+	return 0, nil
+}
 
-		_, err = bufWriter.Write(buf[:n])
-		if err != nil {
-			debug("Error writing file!")
-			status = 500
-			reason = "Internal Server Error"
-			errMsg = fmt.Errorf("Unable to write to file buffer.")
-			return status, reason, errMsg
+// return an http-style status int (e.g,. 201,400,500) and error status
+func uploadHandler(body io.Reader, filePath string) (int, error) {
+	debugf("Attempting to upload to filepath: %s", filePath)
+
+	if fileInfo, err := os.Stat(filePath); err == nil && fileInfo.IsDir() {
+		return 409, fmt.Errorf("Upload target is a directory: %s", filePath)
+	}
+
+	// Stream into a temp file next to the destination, so a failed upload never
+	// touches an existing file and the final rename is atomic
+	uploadDir := filepath.Dir(filePath)
+	if status, err := uploadDirReady(uploadDir); err != nil {
+		return status, err
+	}
+	tempFile, err := os.CreateTemp(uploadDir, ".upload-*")
+	if err != nil {
+		return 500, fmt.Errorf("Unable to create temp file in: %s", uploadDir)
+	}
+	tempPath := tempFile.Name()
+	committed := false
+	defer func() {
+		if !committed {
+			debugf("Removing incomplete upload: %s", tempPath)
+			tempFile.Close()
+			os.Remove(tempPath)
 		}
-		remaining -= int64(n)
+	}()
 
-		// Validate file writing
-		debug("Validating and flushing...")
-		err = bufWriter.Flush()
-		if err != nil {
-			debug("Problem flushing writer!")
-			status = 500
-			reason = "Internal Server Error"
-			errMsg = fmt.Errorf("Unable to validate and flush file writer.")
-			return status, reason, errMsg
+	debug("Streaming request body to temp file...")
+	buf := make([]byte, 32*1024)
+	var written int64
+	for {
+		n, readErr := body.Read(buf)
+		if n > 0 {
+			written += int64(n)
+			if MAX_UPLOAD_SIZE > 0 && written > MAX_UPLOAD_SIZE {
+				return 413, fmt.Errorf("Upload exceeds maximum size of %d bytes.", MAX_UPLOAD_SIZE)
+			}
+			if _, err := tempFile.Write(buf[:n]); err != nil {
+				debug("Error writing file!")
+				return 500, fmt.Errorf("Unable to write to file: %v", err)
+			}
+		}
+		if readErr == io.EOF {
+			break
 		}
+		if readErr != nil {
+			debug("Error reading request body!")
+			return bodyReadErrorStatus(readErr), fmt.Errorf("Unable to read request body: %v", readErr)
+		}
+	}
+	debugf("Received %d bytes, syncing to disk...", written)
+
+	// Temp files are private, give the upload the usual permissions of a new file
+	if err := tempFile.Chmod(0644); err != nil {
+		return 500, fmt.Errorf("Unable to set file permissions: %v", err)
+	}
+	if err := tempFile.Sync(); err != nil {
+		return 500, fmt.Errorf("Unable to sync file: %v", err)
+	}
+	if err := tempFile.Close(); err != nil {
+		return 500, fmt.Errorf("Unable to close file: %v", err)
+	}
+	if err := os.Rename(tempPath, filePath); err != nil {
+		return 500, fmt.Errorf("Unable to move upload into place: %v", err)
 	}
+	committed = true
+	syncDir(uploadDir)
+
 	// Succesfully uploaded file.
 	debug("Successfully uploaded file.")
-	status = 201
-	reason = "Created"
-	errMsg = nil
-	return status, reason, errMsg
+	return 201, nil
 }
 
-func filePostHandler(pathVals string, conn net.Conn, req Http_Request) Http_Response {
-	debugf("filePostHandler request with vals: %s", pathVals)
-	var res Http_Response
-	res.Version = HTTPV
+func filePostHandler(params map[string]string, conn net.Conn, req Http_Request) Http_Response {
+	debugf("filePostHandler request with params: %v", params)
+
+	// Look for Content-Length, chunked uploads are measured as they stream in
+	chunked := req.Headers.Has("Transfer-Encoding")
+	if !chunked {
+		// The parser already refused invalid values, this catches a missing header
+		contentLength := req.Headers.Get("Content-Length")
+		length, err := parseContentLength(contentLength)
+		if err != nil {
+			res := textResponse(400, "")
+			res.Headers.Set("Error", "Content-Length header or length value missing.")
+			return res
+		}
+		debugf("Received content length: %v", contentLength)
+		if MAX_UPLOAD_SIZE > 0 && length > MAX_UPLOAD_SIZE {
+			// Refuse before reading any of the body
+			return textResponse(413, fmt.Sprintf("Upload exceeds maximum size of %d bytes.", MAX_UPLOAD_SIZE))
+		}
+	}
 
-	// Look for Content-Length
-	contentLength := req.Headers["Content-Length"]
-	length, err := strconv.Atoi(contentLength)
+	// Map the file path to a file inside the served directory
+	filePath, err := sandboxPath(params["path"])
 	if err != nil {
-		res = BAD_REQUEST
-		res.Headers["Error"] = "Content-Length header or length value missing."
-		return BAD_REQUEST
+		var httpErr *Http_Error
+		errors.As(err, &httpErr)
+		debugf("Refusing upload: %v", err)
+		return httpErr.Response()
+	}
+
+	if uploadPreconditionFailed(req, filePath) {
+		return textResponse(412, "")
 	}
-	debugf("Content-Length header or value missing. Received content length: %v", contentLength)
 
-	status, reason, err := uploadHandler(int64(length), pathVals, req.Body)
+	status, err := uploadHandler(req.Body, filePath)
 	if err != nil {
-		res = SERVER_ERROR
-		res.Status = status
-		res.Reason = reason
-		res.Headers["Error"] = "Problem with uploading file."
+		logError("Upload failed", err)
+		res := textResponse(status, "")
+		res.Headers.Set("Error", "Problem with uploading file.")
 		return res
 	}
 
 	// Successful file upload
-	res = OK
-	res.Status = status
-	res.Reason = reason
+	res := newResponse(status)
+	if fileInfo, err := os.Stat(filePath); err == nil {
+		setValidators(&res, fileInfo)
+	}
 	return res
 }
 
 func define_routes() {
 	debug("Routes being defined...")
-	routesMutex.Lock()
-	routes["GET /"] = rootHandler
-	routes["GET /echo/{str}"] = echoHandler
-	routes["GET /user-agent"] = userAgentHandler
-	routes["GET /files/{str}"] = fileRequestHandler
-	routes["POST /files/{str}"] = filePostHandler
+	router.Handle("GET /", rootHandler)
+	router.Handle("GET /echo/{str}", echoHandler)
+	router.Handle("GET /user-agent", userAgentHandler)
+	router.Handle("GET /files/{path...}", fileRequestHandler)
+	router.Handle("POST /files/{path...}", filePostHandler)
+
+	// Downloads are public, uploads need a client certificate once --tls-client-ca is set
+	router.SetPolicy("POST /files/{path...}", Route_Policy{RequireClientCert: true})
+
+	for _, pattern := range REDIRECT_EXEMPT {
+		redirectExemptions.Handle(pattern, nil)
+		// Exempt requests go to the routes above, a pattern none of them serves would only 404
+		if !router.Serves(pattern) {
+			handleError("Invalid --redirect-exempt value", fmt.Errorf("No route serves %q", pattern))
+		}
+	}
 
 	debug("Routes ready.")
 }
 
-func connStringToRequest(conn net.Conn) Http_Request {
+// Request Bodies
 
-	reader := bufio.NewReader(conn)
-	debug("bufio reader set, attempt to read all...")
+type emptyBody struct{}
+
+func (emptyBody) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+// noBody is the Body of every request without content
+var noBody io.Reader = emptyBody{}
+
+// lengthBodyReader reads a body framed by Content-Length
+type lengthBodyReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (l *lengthBodyReader) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.reader.Read(p)
+	l.remaining -= int64(n)
+	if err == io.EOF && l.remaining > 0 {
+		// Connection closed before Content-Length bytes arrived
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// deadlineBodyReader gives every read of a body READ_TIMEOUT to make progress,
+// so large uploads can take as long as they need while stalled clients still time out.
+type deadlineBodyReader struct {
+	conn   net.Conn
+	reader io.Reader
+}
+
+func (d *deadlineBodyReader) Read(p []byte) (int, error) {
+	d.conn.SetReadDeadline(deadlineAfter(READ_TIMEOUT))
+	return d.reader.Read(p)
+}
+
+// drainBody discards what the handler left unread of a request body and reports
+// if the connection is positioned at the next request. Bodies larger than
+// MAX_BODY_DRAIN aren't worth reading, the connection is closed instead.
+func drainBody(req Http_Request) bool {
+	n, err := io.CopyN(io.Discard, req.Body, MAX_BODY_DRAIN+1)
+	if err == io.EOF {
+		debugf("Drained %d unread body bytes", n)
+		return true
+	}
+	debugf("Unable to drain request body after %d bytes: %v", n, err)
+	return false
+}
+
+// connStringToRequest parses the next request from the connection's reader.
+// The reader is shared by every request on the connection, so bytes buffered
+// past the end of this request belong to the next pipelined one.
+func connStringToRequest(conn net.Conn, reader *bufio.Reader) (Http_Request, error) {
+	debug("Reading next request from connection reader...")
 	// Read lines
 	lineCount := 0
+	headerBytes := 0
 	lines, headers := "", ""
 	method, target, version := "", "", ""
 
 	for {
-		line, err := reader.ReadString('\n')
+		// Lines are read with a size cap, so an endless line can't exhaust memory
+		limit := MAX_REQUEST_LINE
+		if lineCount > 0 {
+			limit = MAX_HEADER_BYTES - headerBytes
+		}
+		line, err := readLimitedLine(reader, limit)
+		if err == errLineTooLong {
+			if lineCount == 0 {
+				return Http_Request{}, newHttpError(414, "Request line exceeds the length limit.")
+			}
+			return Http_Request{}, newHttpError(431, "Request headers exceed the size limit.")
+		}
 		if err != nil {
-			handleError("Error reading lines: ", err)
-			return Http_Request{}
+			requestStarted := lineCount > 0 || len(line) > 0
+			if !requestStarted && err == io.EOF {
+				// Client closed the connection between requests
+				return Http_Request{}, io.EOF
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() && requestStarted {
+				return Http_Request{}, newHttpError(408, "Timed out reading request headers.")
+			}
+			debugf("Error reading lines: %v", err)
+			return Http_Request{}, err
+		}
+		if lineCount == 0 && (line == CRLF || line == "\n") {
+			// Empty lines ahead of the request line are ignored, see RFC 9112 section 2.2
+			debug("Skipping empty line before request line")
+			continue
 		}
 		if lineCount == 0 {
 			// first line has the method, target and http version
-			parts := strings.Split(line, " ")
-			if len(parts) != 3 {
-				err := fmt.Errorf("Line does not have three parts. Received: %v", line)
-				handleError("First line doesn't appear to be a valid http request", err)
+			method, target, version, err = parseRequestLine(line)
+			if err != nil {
+				return Http_Request{}, err
 			}
-			method = parts[0]
-			target = parts[1]
-			version = parts[2]
 			debugf("Parsed method: %s\nParsed target: %s\nParsed version: %s", method, target, version)
 		}
-		if lineCount > 0 {
-			// get headers
-			headers += line
-		}
 		lineCount++
 
 		debugf("Found %d header lines: %s", lineCount, line)
-		if line == CRLF {
+		if lineCount > 1 && (line == CRLF || line == "\n") {
+			if STRICT_PARSING && line != CRLF {
+				return Http_Request{}, newHttpError(400, "Lines must end with CRLF.")
+			}
 			break // end of headers
 		}
+		if lineCount > 1 {
+			// get headers
+			headerBytes += len(line)
+			if lineCount-1 > MAX_HEADER_COUNT {
+				return Http_Request{}, newHttpError(431, "Too many request headers.")
+			}
+			if STRICT_PARSING {
+				if err := validateHeaderLine(line); err != nil {
+					return Http_Request{}, err
+				}
+			}
+			headers += line
+		}
 		lines += line
 	}
 
 	debug("End of headers, building Headers map...")
 	headersMap := headersStringToMap(headers)
+	if STRICT_PARSING {
+		if err := validateHeaders(version, headersMap); err != nil {
+			return Http_Request{}, err
+		}
+	}
+
+	// Absolute-form targets are routed by their path, their authority replaces Host
+	if path, host, ok := splitAbsoluteTarget(target); ok {
+		debugf("Absolute-form target, routing %s for host %s", path, host)
+		target = path
+		headersMap.Set("Host", host)
+	}
 	debug("Headers map built, looking for Content-Type and Content-Length...")
 
-	// Get body content length
-	contentLength := 0
+	// Get body content length, repeated Content-Length lines must agree
+	var contentLength int64
 	contentType := ""
-	contentLength, err := strconv.Atoi(headersMap["Content-Length"])
-	if err != nil {
-		contentLength = 0
+	contentLengths := headersMap.Values("Content-Length")
+	for _, value := range contentLengths {
+		if value != contentLengths[0] {
+			return Http_Request{}, newHttpError(400, "Conflicting Content-Length values.")
+		}
+	}
+	if len(contentLengths) > 0 {
+		// An unreadable length leaves no way to find where the body ends
+		length, err := parseContentLength(contentLengths[0])
+		if err != nil {
+			return Http_Request{}, err
+		}
+		contentLength = length
 	}
 	debugf("contentLength: %d", contentLength)
-	contentType = strings.TrimSpace(headersMap["Content-Type"])
+	contentType = strings.TrimSpace(headersMap.Get("Content-Type"))
 	if len(contentType) == 0 {
 		contentType = ""
 	}
 	debugf("contentType: %s", contentType)
 
-	// Read full content length of body
+	// A body is framed by either Transfer-Encoding or Content-Length, never both
+	chunked := false
+	if headersMap.Has("Transfer-Encoding") {
+		if headersMap.Has("Content-Length") {
+			return Http_Request{}, newHttpError(400, "Content-Length and Transfer-Encoding must not both be sent.")
+		}
+		codings := headerTokens(headersMap, "Transfer-Encoding")
+		if len(codings) == 0 || codings[len(codings)-1] != "chunked" {
+			return Http_Request{}, newHttpError(400, "Final transfer coding must be chunked.")
+		}
+		if len(codings) > 1 {
+			return Http_Request{}, newHttpError(501, "Unsupported transfer coding: "+strings.Join(codings, ", "))
+		}
+		chunked = true
+	}
+	debugf("chunked: %v", chunked)
+
+	if MAX_BODY_SIZE > 0 && contentLength > MAX_BODY_SIZE {
+		// Refused before reading or allocating anything for the body
+		return Http_Request{}, newHttpError(413, "Request body exceeds the size limit.")
+	}
 
-	// Setting a 5-second read deadline to prevent blocking
-	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-	debug("Attempting to get request body...")
-	body := make([]byte, int64(contentLength))
-	debugf("Ready to read %d bytes", contentLength)
-	n, err := io.ReadFull(reader, body)
-	debugf("Read %d bytes", n)
-	if err != nil {
-		if err == io.EOF {
-			debug("Received EOF")
-		} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-			handleError("Timeout reading body: ", err)
-		} else {
-			handleError("Error reading body: ", err)
+	// The body stays on the connection for the handler to stream
+	var body io.Reader = noBody
+	trailers := make(Http_Header)
+	if chunked {
+		debug("Request body uses chunked transfer coding")
+		body = newChunkedBodyReader(reader, trailers)
+		if MAX_BODY_SIZE > 0 {
+			body = &maxBodyReader{reader: body, remaining: MAX_BODY_SIZE}
 		}
-		return Http_Request{}
+	} else if contentLength > 0 {
+		debugf("Request body has %d bytes", contentLength)
+		body = &lengthBodyReader{reader: reader, remaining: contentLength}
+	}
+	if body != noBody {
+		body = &deadlineBodyReader{conn: conn, reader: body}
 	}
 
 	debug("Building Http_Request")
 	// Build Http_Request type
 	connRequest := Http_Request{
-		Method:  method,
-		Target:  target,
-		Version: version,
-		Headers: headersStringToMap(headers),
-		Body:    string(body),
+		Method:   method,
+		Target:   target,
+		Version:  version,
+		Headers:  headersMap,
+		Body:     body,
+		Trailers: trailers,
 	}
 
-	return connRequest
+	return connRequest, nil
+}
+
+// Pipelining
+
+// pipelinedResponse is the slot a handler fills for one request on a connection.
+// Slots are queued in request order, so responses go out in that order no matter
+// which handler finishes first.
+type pipelinedResponse struct {
+	request   Http_Request
+	result    chan Http_Response
+	keepAlive bool
+}
+
+func pipelineWriter(conn net.Conn, pending <-chan *pipelinedResponse, done chan<- struct{}) {
+	defer close(done)
+	defer func() {
+		// Streaming bodies run handler code while writing, don't let them take the server down
+		if recovered := recover(); recovered != nil {
+			logPanic(fmt.Sprintf("Response writer panicked on connection from %s", conn.RemoteAddr()), recovered)
+			conn.Close()
+			for slot := range pending {
+				discardBody(<-slot.result)
+			}
+		}
+	}()
+	for slot := range pending {
+		res := <-slot.result
+		debug("Next pipelined response ready, writing...")
+		// Once shutdown begins every response asks the client to close the connection
+		keepAlive := slot.keepAlive && !connections.isShuttingDown()
+		written := responseWriter(conn, slot.request, res, keepAlive)
+		connections.responseWritten(conn)
+		if !written {
+			debug("Last response on connection written.")
+			// Unblock the reading side and drop anything still queued
+			conn.Close()
+			for slot := range pending {
+				discardBody(<-slot.result)
+			}
+			return
+		}
+	}
 }
 
 func handleConnection(conn net.Conn) {
 	debug("Handling new connection...")
 	defer conn.Close()
-	connRequest := connStringToRequest(conn)
-	handleRequests(conn, connRequest)
+	defer connections.untrack(conn)
+	defer func() {
+		// Last line of defence, the accept loop in main must keep running
+		if recovered := recover(); recovered != nil {
+			logPanic(fmt.Sprintf("Connection from %s panicked", conn.RemoteAddr()), recovered)
+		}
+	}()
+
+	if !tlsHandshake(conn) {
+		return
+	}
+	clientSubject := verifiedClientSubject(conn)
+	if len(clientSubject) > 0 {
+		debugf("Client authenticated as %s", clientSubject)
+	}
+
+	// One reader for the whole connection so pipelined bytes are never dropped
+	reader := bufio.NewReader(conn)
+	pending := make(chan *pipelinedResponse, MAX_PIPELINED)
+	writerDone := make(chan struct{})
+	go pipelineWriter(conn, pending, writerDone)
+	defer func() {
+		// Let the writer flush every queued response before the connection closes
+		close(pending)
+		<-writerDone
+	}()
+
+	for {
+		// Wait at most IDLE_TIMEOUT after the last response for the next request on
+		// this connection, shutdown closes the connection while it waits
+		if !connections.setWaiting(conn, true) {
+			debug("Shutting down, closing connection.")
+			return
+		}
+		if _, err := reader.Peek(1); err != nil {
+			if err == io.EOF {
+				debug("Client closed the connection.")
+			} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				debug("Idle timeout reached, closing connection.")
+			} else if errors.Is(err, net.ErrClosed) {
+				debug("Idle connection closed by shutdown.")
+			} else {
+				logError(fmt.Sprintf("Closing connection from %s after read error", conn.RemoteAddr()), err)
+			}
+			return
+		}
+		if !connections.setWaiting(conn, false) {
+			return
+		}
+		// A request has started, the whole header section must follow within READ_HEADER_TIMEOUT
+		conn.SetReadDeadline(deadlineAfter(READ_HEADER_TIMEOUT))
+		connRequest, err := connStringToRequest(conn, reader)
+		if err != nil {
+			var httpErr *Http_Error
+			if errors.As(err, &httpErr) {
+				logError(fmt.Sprintf("Rejecting request from %s", conn.RemoteAddr()), httpErr)
+				slot := &pipelinedResponse{result: make(chan Http_Response, 1), keepAlive: false}
+				slot.result <- httpErr.Response()
+				connections.responseQueued(conn)
+				pending <- slot
+			} else if err == io.EOF {
+				debug("Client closed the connection.")
+			} else {
+				logError(fmt.Sprintf("Closing connection from %s after read error", conn.RemoteAddr()), err)
+			}
+			return
+		}
+
+		connRequest.ClientSubject = clientSubject
+		keepAlive := keepAliveRequested(connRequest)
+		slot := &pipelinedResponse{request: connRequest, result: make(chan Http_Response, 1), keepAlive: keepAlive}
+		connections.responseQueued(conn)
+		// Blocks once MAX_PIPELINED responses are outstanding
+		pending <- slot
+		bodyDone := make(chan struct{})
+		go func(req Http_Request) {
+			res := handleRequests(conn, req)
+			if !drainBody(req) {
+				slot.keepAlive = false
+			}
+			close(bodyDone)
+			slot.result <- res
+		}(connRequest)
+		if connRequest.Body != noBody {
+			// The next request starts where this body ends, wait for the handler to read it
+			<-bodyDone
+			keepAlive = slot.keepAlive
+		}
+		if !keepAlive {
+			debug("Connection not kept alive, closing.")
+			return
+		}
+	}
 }
 
 func main() {
@@ -755,20 +1361,17 @@ func main() {
 	if DEBUGGER {
 		fmt.Println("Debugging turned on")
 	}
-	listener, err := net.Listen("tcp", "0.0.0.0:4221")
-	if err != nil {
-		handleError("Failed to bind to 0.0.0.0 (localhost) port 4221", err)
+	listeners, redirectListeners := openListeners()
+	var wg sync.WaitGroup
+	for _, listener := range wrapListeners(listeners) {
+		wg.Add(1)
+		go acceptLoop(listener, &wg)
 	}
-	defer listener.Close()
-
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			handleError("Error accepting connection.", err)
-			continue
-		}
-		go handleConnection(conn)
-
+	for _, listener := range redirectListeners {
+		wg.Add(1)
+		go acceptLoop(redirectListener{listener}, &wg)
 	}
+	notifyReady()
+	waitForShutdown(listeners, redirectListeners, &wg)
 
 }
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Graceful Shutdown
+
+// How long active connections get to finish after SIGINT or SIGTERM before
+// they are cut off, set by --shutdown-timeout
+var SHUTDOWN_TIMEOUT = 30 * time.Second
+
+// connRegistry tracks every open connection and whether it is idle, so
+// shutdown can close idle ones right away and wait for the rest.
+type connRegistry struct {
+	mutex        sync.Mutex
+	conns        map[net.Conn]*connState
+	shuttingDown bool
+	wg           sync.WaitGroup
+}
+
+// connState is idle while the connection waits for its next request with
+// every response to earlier ones written
+type connState struct {
+	waiting     bool
+	outstanding int // responses queued or being written
+}
+
+func (s *connState) idle() bool {
+	return s.waiting && s.outstanding == 0
+}
+
+var connections = &connRegistry{conns: make(map[net.Conn]*connState)}
+
+// track registers a new connection, it reports false once shutdown has begun
+func (r *connRegistry) track(conn net.Conn) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.shuttingDown {
+		return false
+	}
+	r.conns[conn] = &connState{}
+	r.wg.Add(1)
+	return true
+}
+
+func (r *connRegistry) untrack(conn net.Conn) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, exists := r.conns[conn]; exists {
+		delete(r.conns, conn)
+		r.wg.Done()
+	}
+}
+
+// setWaiting marks if conn is waiting for its next request. It reports false
+// when shutdown has begun, the connection should then stop reading requests.
+// The wait only counts against IDLE_TIMEOUT once every response is written,
+// until then the read deadline is lifted and responseWritten sets it.
+func (r *connRegistry) setWaiting(conn net.Conn, waiting bool) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.shuttingDown {
+		return false
+	}
+	state, exists := r.conns[conn]
+	if !exists {
+		if waiting {
+			conn.SetReadDeadline(deadlineAfter(IDLE_TIMEOUT))
+		}
+		return true
+	}
+	state.waiting = waiting
+	if waiting && state.idle() {
+		conn.SetReadDeadline(deadlineAfter(IDLE_TIMEOUT))
+	} else if waiting {
+		debug("Responses still outstanding, idle timeout starts once they are written")
+		conn.SetReadDeadline(time.Time{})
+	}
+	return true
+}
+
+// responseQueued counts a response conn owes its client, the connection isn't
+// idle until it has been written
+func (r *connRegistry) responseQueued(conn net.Conn) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if state, exists := r.conns[conn]; exists {
+		state.outstanding++
+	}
+}
+
+// responseWritten counts a response as sent. A connection that turns idle
+// starts its idle timeout now, or is closed when shutdown has begun since
+// closeIdle skipped it.
+func (r *connRegistry) responseWritten(conn net.Conn) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	state, exists := r.conns[conn]
+	if !exists {
+		return
+	}
+	state.outstanding--
+	if !state.idle() {
+		return
+	}
+	if r.shuttingDown {
+		debugf("Closing connection from %s after its last response", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(deadlineAfter(IDLE_TIMEOUT))
+}
+
+func (r *connRegistry) isShuttingDown() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.shuttingDown
+}
+
+// closeIdle starts the shutdown, closing every connection waiting for a
+// request with nothing left to write
+func (r *connRegistry) closeIdle() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.shuttingDown = true
+	for conn, state := range r.conns {
+		if state.idle() {
+			debugf("Closing idle connection from %s", conn.RemoteAddr())
+			conn.Close()
+		}
+	}
+}
+
+// closeAll cuts off every connection still open
+func (r *connRegistry) closeAll() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for conn := range r.conns {
+		conn.Close()
+	}
+	return len(r.conns)
+}
+
+// drain waits up to timeout for every connection to finish, it reports false
+// if some had to be cut off
+func (r *connRegistry) drain(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-done:
+		return true
+	case <-expired:
+		logError("Shutdown timeout reached", fmt.Errorf("Closing %d connections still in use", r.closeAll()))
+		return false
+	}
+}
+
+// waitForShutdown blocks until SIGINT or SIGTERM, then stops accepting
+// connections, lets active ones finish within SHUTDOWN_TIMEOUT and exits.
+// SIGHUP and SIGUSR2 first hand the listeners off to a new process.
+// A second signal exits immediately.
+func waitForShutdown(listeners []net.Listener, redirectListeners []net.Listener, acceptLoops *sync.WaitGroup) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR2)
+	for received := range signals {
+		if received == syscall.SIGHUP || received == syscall.SIGUSR2 {
+			fmt.Printf("Received %v, restarting...\n", received)
+			if err := handoffListeners(listeners, redirectListeners); err != nil {
+				// Keep serving, a failed restart mustn't take the server down
+				logError("Unable to start new process", err)
+				continue
+			}
+		}
+		fmt.Printf("Received %v, shutting down...\n", received)
+		break
+	}
+	go func() {
+		<-signals
+		fmt.Println("Received second signal, exiting immediately.")
+		os.Exit(1)
+	}()
+
+	for _, listener := range append(listeners, redirectListeners...) {
+		// Unix listeners also remove their socket file, unless it was handed off
+		listener.Close()
+	}
+	acceptLoops.Wait()
+	connections.closeIdle()
+
+	if !connections.drain(SHUTDOWN_TIMEOUT) {
+		os.Exit(1)
+	}
+	fmt.Println("All connections closed, exiting.")
+	os.Exit(0)
+}
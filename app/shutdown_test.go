@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// isClosed reports if conn was closed on this side
+func isClosed(conn net.Conn) bool {
+	_, err := conn.Write([]byte{0})
+	return err == io.ErrClosedPipe
+}
+
+// pipeConn returns a connection whose writes are read and dropped on the other end
+func pipeConn(t *testing.T) net.Conn {
+	conn, peer := net.Pipe()
+	go io.Copy(io.Discard, peer)
+	t.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+	return conn
+}
+
+func TestCloseIdleSkipsOutstandingResponses(t *testing.T) {
+	registry := &connRegistry{conns: make(map[net.Conn]*connState)}
+	idle := pipeConn(t)
+	writing := pipeConn(t)
+	reading := pipeConn(t)
+	for _, conn := range []net.Conn{idle, writing, reading} {
+		registry.track(conn)
+	}
+	// idle wrote its only response, writing still sends one, reading is mid request
+	registry.responseQueued(idle)
+	registry.responseWritten(idle)
+	registry.setWaiting(idle, true)
+	registry.responseQueued(writing)
+	registry.setWaiting(writing, true)
+
+	registry.closeIdle()
+	if !isClosed(idle) {
+		t.Error("idle connection left open by closeIdle")
+	}
+	if isClosed(writing) {
+		t.Error("connection with a response being written closed by closeIdle")
+	}
+	if isClosed(reading) {
+		t.Error("connection reading a request closed by closeIdle")
+	}
+
+	registry.responseWritten(writing)
+	if !isClosed(writing) {
+		t.Error("connection left open after its last response during shutdown")
+	}
+	if registry.setWaiting(reading, true) {
+		t.Error("setWaiting reports true during shutdown")
+	}
+	if registry.track(pipeConn(t)) {
+		t.Error("track reports true during shutdown")
+	}
+}
+
+func TestIdleTimeoutStartsAfterLastResponse(t *testing.T) {
+	previous := IDLE_TIMEOUT
+	IDLE_TIMEOUT = 50 * time.Millisecond
+	t.Cleanup(func() { IDLE_TIMEOUT = previous })
+
+	registry := &connRegistry{conns: make(map[net.Conn]*connState)}
+	conn, peer := net.Pipe()
+	t.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+	registry.track(conn)
+	registry.responseQueued(conn)
+	registry.setWaiting(conn, true)
+
+	// A response longer than IDLE_TIMEOUT is still being written
+	go func() {
+		time.Sleep(2 * IDLE_TIMEOUT)
+		peer.Write([]byte{0})
+	}()
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("read timed out while a response was outstanding: %v", err)
+	}
+
+	registry.responseWritten(conn)
+	_, err := conn.Read(make([]byte, 1))
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Errorf("read after the last response = %v, want a timeout", err)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import "strconv"
+
+// Status Codes
+
+// statusText holds the reason phrase of every status code defined by RFC 9110,
+// plus the RFC 6585 additions the server relies on
+var statusText = map[int]string{
+	100: "Continue",
+	101: "Switching Protocols",
+
+	200: "OK",
+	201: "Created",
+	202: "Accepted",
+	203: "Non-Authoritative Information",
+	204: "No Content",
+	205: "Reset Content",
+	206: "Partial Content",
+
+	300: "Multiple Choices",
+	301: "Moved Permanently",
+	302: "Found",
+	303: "See Other",
+	304: "Not Modified",
+	305: "Use Proxy",
+	306: "Unused",
+	307: "Temporary Redirect",
+	308: "Permanent Redirect",
+
+	400: "Bad Request",
+	401: "Unauthorized",
+	402: "Payment Required",
+	403: "Forbidden",
+	404: "Not Found",
+	405: "Method Not Allowed",
+	406: "Not Acceptable",
+	407: "Proxy Authentication Required",
+	408: "Request Timeout",
+	409: "Conflict",
+	410: "Gone",
+	411: "Length Required",
+	412: "Precondition Failed",
+	413: "Content Too Large",
+	414: "URI Too Long",
+	415: "Unsupported Media Type",
+	416: "Range Not Satisfiable",
+	417: "Expectation Failed",
+	418: "Unused",
+	421: "Misdirected Request",
+	422: "Unprocessable Content",
+	426: "Upgrade Required",
+	428: "Precondition Required",
+	429: "Too Many Requests",
+	431: "Request Header Fields Too Large",
+
+	500: "Internal Server Error",
+	501: "Not Implemented",
+	502: "Bad Gateway",
+	503: "Service Unavailable",
+	504: "Gateway Timeout",
+	505: "HTTP Version Not Supported",
+	511: "Network Authentication Required",
+}
+
+// statusReason returns the reason phrase for status, unknown codes get a
+// generic phrase for their class
+func statusReason(status int) string {
+	if reason, exists := statusText[status]; exists {
+		return reason
+	}
+	switch status / 100 {
+	case 1:
+		return "Informational"
+	case 2:
+		return "Success"
+	case 3:
+		return "Redirection"
+	case 4:
+		return "Client Error"
+	case 5:
+		return "Server Error"
+	}
+	return "Status " + strconv.Itoa(status)
+}
+
+// newResponse returns a fresh, empty response for status. Every call gets its
+// own Headers map, so handlers are free to modify it.
+func newResponse(status int) Http_Response {
+	return Http_Response{
+		Version: HTTPV,
+		Status:  status,
+		Reason:  statusReason(status),
+		Headers: make(Http_Header),
+		Body:    "",
+	}
+}
+
+// textResponse returns a fresh text/plain response for status with body
+func textResponse(status int, body string) Http_Response {
+	res := newResponse(status)
+	res.Headers.Set("Content-Type", "text/plain")
+	res.Body = body
+	return res
+}
+
+// setStatus changes the status of res along with its reason phrase
+func setStatus(res *Http_Response, status int) {
+	res.Status = status
+	res.Reason = statusReason(status)
+}
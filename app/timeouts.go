@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// Connection Timeouts
+// A timeout of 0 means no limit.
+
+// How long a keep-alive connection may sit idle waiting for its next request
+var IDLE_TIMEOUT = 60 * time.Second
+
+// How long a client has to send the request line and headers once the first
+// byte of a request arrived, so a slowloris client can't hold a connection open
+var READ_HEADER_TIMEOUT = 10 * time.Second
+
+// How long each read of a request body may stall before it times out
+var READ_TIMEOUT = 30 * time.Second
+
+// How long each write of a response may stall before it times out
+var WRITE_TIMEOUT = 30 * time.Second
+
+// Size of the pieces a file is sent in, each one gets a fresh write deadline
+const WRITE_SEGMENT_SIZE = 4 * 1024 * 1024
+
+// deadlineAfter returns the deadline timeout from now, or no deadline for 0
+func deadlineAfter(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// deadlineWriter gives every write to the connection WRITE_TIMEOUT to make progress,
+// so large downloads can take as long as they need while stalled readers still time out.
+type deadlineWriter struct {
+	conn net.Conn
+}
+
+func (d *deadlineWriter) Write(p []byte) (int, error) {
+	d.conn.SetWriteDeadline(deadlineAfter(WRITE_TIMEOUT))
+	return d.conn.Write(p)
+}
+
+// ReadFrom keeps sendfile for segments of a file, see streamBody. Any other
+// reader is copied through Write so each buffer gets its own deadline.
+func (d *deadlineWriter) ReadFrom(r io.Reader) (int64, error) {
+	if limited, ok := r.(*io.LimitedReader); ok {
+		if _, isFile := limited.R.(*os.File); isFile {
+			d.conn.SetWriteDeadline(deadlineAfter(WRITE_TIMEOUT))
+			return io.Copy(d.conn, limited)
+		}
+	}
+	return io.Copy(struct{ io.Writer }{d}, r)
+}
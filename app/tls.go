@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLS
+
+// Certificate and key files, set by --tls-cert and --tls-key. Pairs are
+// matched by position and chosen per connection by SNI, the first pair is
+// the default. HTTPS is off when none are given.
+var TLS_CERT_FILES []string
+var TLS_KEY_FILES []string
+
+// How often certificate files are checked for changes
+var TLS_RELOAD_INTERVAL = 10 * time.Second
+
+// certPair is one certificate and key loaded from disk
+type certPair struct {
+	certFile    string
+	keyFile     string
+	certModTime time.Time
+	keyModTime  time.Time
+	cert        *tls.Certificate
+}
+
+// certStore holds the loaded certificates, they are swapped out in place when
+// their files change so new handshakes pick them up without a restart
+type certStore struct {
+	mutex sync.RWMutex
+	pairs []*certPair
+}
+
+func fileModTime(path string) (time.Time, error) {
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fileInfo.ModTime(), nil
+}
+
+func loadCertPair(certFile string, keyFile string) (*certPair, error) {
+	pair := &certPair{certFile: certFile, keyFile: keyFile}
+	var err error
+	// Read the times first, a change while loading is then picked up next poll
+	if pair.certModTime, err = fileModTime(certFile); err != nil {
+		return nil, err
+	}
+	if pair.keyModTime, err = fileModTime(keyFile); err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	// Parsed up front so SNI matching doesn't parse it on every handshake
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	pair.cert = &cert
+	debugf("Loaded certificate %s for %v", certFile, cert.Leaf.DNSNames)
+	return pair, nil
+}
+
+func newCertStore(certFiles []string, keyFiles []string) (*certStore, error) {
+	if len(certFiles) != len(keyFiles) {
+		return nil, fmt.Errorf("Received %d --tls-cert and %d --tls-key values", len(certFiles), len(keyFiles))
+	}
+	store := &certStore{}
+	for i := range certFiles {
+		pair, err := loadCertPair(certFiles[i], keyFiles[i])
+		if err != nil {
+			return nil, err
+		}
+		store.pairs = append(store.pairs, pair)
+	}
+	return store, nil
+}
+
+// reload loads every pair whose files changed. A pair that fails to load,
+// for example while only one of its files has been replaced, keeps serving
+// the old certificate and is retried on the next poll.
+func (s *certStore) reload() {
+	s.mutex.RLock()
+	pairs := append([]*certPair(nil), s.pairs...)
+	s.mutex.RUnlock()
+
+	for i, pair := range pairs {
+		certModTime, certErr := fileModTime(pair.certFile)
+		keyModTime, keyErr := fileModTime(pair.keyFile)
+		if certErr != nil || keyErr != nil {
+			continue
+		}
+		if certModTime.Equal(pair.certModTime) && keyModTime.Equal(pair.keyModTime) {
+			continue
+		}
+		reloaded, err := loadCertPair(pair.certFile, pair.keyFile)
+		if err != nil {
+			logError(fmt.Sprintf("Unable to reload certificate %s", pair.certFile), err)
+			continue
+		}
+		s.mutex.Lock()
+		s.pairs[i] = reloaded
+		s.mutex.Unlock()
+		fmt.Printf("Reloaded certificate %s\n", pair.certFile)
+	}
+}
+
+// watch polls the certificate files every interval for as long as the server runs
+func (s *certStore) watch(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	for range time.Tick(interval) {
+		s.reload()
+	}
+}
+
+// getCertificate picks the first certificate valid for the server name the
+// client asked for, falling back to the first one loaded
+func (s *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if len(hello.ServerName) > 0 {
+		for _, pair := range s.pairs {
+			if hello.SupportsCertificate(pair.cert) == nil {
+				return pair.cert, nil
+			}
+		}
+		debugf("No certificate for server name %s, using the default", hello.ServerName)
+	}
+	return s.pairs[0].cert, nil
+}
+
+// newTLSConfig returns the server configuration: TLS 1.2 and up with only
+// forward secret AEAD cipher suites. TLS 1.3 suites aren't configurable and
+// are all fine.
+func newTLSConfig(store *certStore) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		NextProtos:       []string{"http/1.1"},
+		GetCertificate:   store.getCertificate,
+	}
+}
+
+// tlsEnabled reports if the server was started in HTTPS mode
+func tlsEnabled() bool {
+	return len(TLS_CERT_FILES) > 0 || len(TLS_KEY_FILES) > 0
+}
+
+// wrapListeners turns the TCP listeners into TLS listeners when HTTPS is on.
+// Unix sockets are local and stay plaintext. The unwrapped listeners are
+// still the ones to close and hand off.
+func wrapListeners(listeners []net.Listener) []net.Listener {
+	if !tlsEnabled() {
+		return listeners
+	}
+	store, err := newCertStore(TLS_CERT_FILES, TLS_KEY_FILES)
+	if err != nil {
+		handleError("Unable to load TLS certificates", err)
+	}
+	go store.watch(TLS_RELOAD_INTERVAL)
+	config := newTLSConfig(store)
+	if err := configureClientAuth(config); err != nil {
+		handleError("Unable to set up client certificates", err)
+	}
+
+	wrapped := make([]net.Listener, 0, len(listeners))
+	httpsPortSet := false
+	for _, listener := range listeners {
+		if listener.Addr().Network() == "unix" {
+			wrapped = append(wrapped, listener)
+			continue
+		}
+		debugf("Serving HTTPS on %s", listener.Addr())
+		if !httpsPortSet {
+			// Redirects point to the first HTTPS listener
+			if _, port, err := net.SplitHostPort(listener.Addr().String()); err == nil {
+				HTTPS_PORT = port
+				httpsPortSet = true
+			}
+		}
+		wrapped = append(wrapped, tls.NewListener(listener, config))
+	}
+	return wrapped
+}
+
+// looksLikeHTTP reports if the first bytes of a connection are an HTTP method
+func looksLikeHTTP(header []byte) bool {
+	for _, method := range []string{"GET ", "HEAD ", "POST ", "PUT ", "DELETE ", "OPTIONS ", "PATCH "} {
+		if strings.HasPrefix(method, string(header)) || strings.HasPrefix(string(header), method) {
+			return true
+		}
+	}
+	return false
+}
+
+// tlsHandshake completes the handshake of a TLS connection within
+// READ_HEADER_TIMEOUT, it reports false when the connection should be dropped
+func tlsHandshake(conn net.Conn) bool {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return true
+	}
+	tlsConn.SetDeadline(deadlineAfter(READ_HEADER_TIMEOUT))
+	if err := tlsConn.Handshake(); err != nil {
+		debugf("TLS handshake with %s failed: %v", conn.RemoteAddr(), err)
+		var recordErr tls.RecordHeaderError
+		if errors.As(err, &recordErr) && recordErr.Conn != nil && looksLikeHTTP(recordErr.RecordHeader[:]) {
+			// A plaintext request on the HTTPS port, tell the client instead of hanging up
+			res := textResponse(400, "Client sent an HTTP request to an HTTPS server.")
+			res.Headers.Set("Connection", "close")
+			res.Headers.Set("Content-Length", strconv.Itoa(len(res.Body)))
+			recordErr.Conn.Write([]byte(buildResponseString(res)))
+		}
+		return false
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return true
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Strict Request Parsing (RFC 9112)
+
+// Set by --strict. Requests that a lenient parser could read more than one way
+// are rejected, closing the door on request smuggling through this server.
+var STRICT_PARSING bool
+
+// isTokenChar reports if c may appear in a token, such as a method or field name
+func isTokenChar(c byte) bool {
+	if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) != -1
+}
+
+func isToken(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isTokenChar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// isFieldValueChar reports if c may appear in a field value: visible ASCII,
+// obs-text, space and horizontal tab
+func isFieldValueChar(c byte) bool {
+	return c == ' ' || c == '\t' || c >= 0x21 && c != 0x7f
+}
+
+// trimLineEnding strips CRLF from a line, refusing a bare LF in strict mode
+func trimLineEnding(line string) (string, error) {
+	if strings.HasSuffix(line, CRLF) {
+		return strings.TrimSuffix(line, CRLF), nil
+	}
+	if STRICT_PARSING {
+		return "", newHttpError(400, "Lines must end with CRLF.")
+	}
+	return strings.TrimSuffix(line, "\n"), nil
+}
+
+// parseHTTPVersion validates "HTTP/x.y", only major version 1 is spoken here
+func parseHTTPVersion(version string) error {
+	if len(version) != 8 || !strings.HasPrefix(version, "HTTP/") || version[6] != '.' ||
+		version[5] < '0' || version[5] > '9' || version[7] < '0' || version[7] > '9' {
+		return newHttpError(400, "Malformed HTTP version.")
+	}
+	if version[5] != '1' {
+		return newHttpError(505, "Only HTTP/1.x is supported.")
+	}
+	return nil
+}
+
+// validateTarget checks the request target is in a form allowed for method:
+// origin-form, absolute-form, authority-form for CONNECT or "*" for OPTIONS
+func validateTarget(method string, target string) error {
+	for i := 0; i < len(target); i++ {
+		if target[i] <= 0x20 || target[i] >= 0x7f || target[i] == '#' {
+			return newHttpError(400, "Invalid character in request target.")
+		}
+	}
+	switch {
+	case strings.HasPrefix(target, "/"):
+		return nil
+	case target == "*":
+		if method != "OPTIONS" {
+			return newHttpError(400, "Asterisk-form is only allowed with OPTIONS.")
+		}
+		return nil
+	case method == "CONNECT":
+		if strings.Contains(target, "/") || !strings.Contains(target, ":") {
+			return newHttpError(400, "CONNECT requires an authority-form target.")
+		}
+		return nil
+	}
+	parsed, err := url.Parse(target)
+	if err != nil || parsed.Host == "" || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return newHttpError(400, "Malformed request target.")
+	}
+	return nil
+}
+
+// parseRequestLine splits "method SP target SP version". The lenient mode only
+// needs three parts, strict mode validates each of them.
+func parseRequestLine(line string) (string, string, string, error) {
+	line, err := trimLineEnding(line)
+	if err != nil {
+		return "", "", "", err
+	}
+	parts := strings.Split(line, " ")
+	if len(parts) != 3 {
+		debugf("Line does not have three parts. Received: %v", line)
+		return "", "", "", newHttpError(400, "Malformed request line.")
+	}
+	method, target, version := parts[0], parts[1], strings.TrimSpace(parts[2])
+	if !STRICT_PARSING {
+		return method, target, version, nil
+	}
+
+	if !isToken(method) {
+		return "", "", "", newHttpError(400, "Invalid request method.")
+	}
+	if err := parseHTTPVersion(version); err != nil {
+		return "", "", "", err
+	}
+	if err := validateTarget(method, target); err != nil {
+		return "", "", "", err
+	}
+	return method, target, version, nil
+}
+
+// validateHeaderLine applies the strict field-line rules to one header line,
+// still including its line ending
+func validateHeaderLine(line string) error {
+	field, err := trimLineEnding(line)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(field, " ") || strings.HasPrefix(field, "\t") {
+		return newHttpError(400, "Obsolete line folding is not allowed.")
+	}
+	name, value, found := strings.Cut(field, ":")
+	if !found {
+		return newHttpError(400, "Header line without a colon.")
+	}
+	if !isToken(name) {
+		// Also catches whitespace between the field name and colon
+		return newHttpError(400, "Invalid header field name.")
+	}
+	for i := 0; i < len(value); i++ {
+		if !isFieldValueChar(value[i]) {
+			return newHttpError(400, "Invalid character in header field value.")
+		}
+	}
+	return nil
+}
+
+// parseContentLength reads a Content-Length value, only 1*DIGIT is accepted so
+// signs, whitespace and lists can't make two parsers disagree on the length
+func parseContentLength(value string) (int64, error) {
+	if len(value) == 0 || strings.Trim(value, "0123456789") != "" {
+		return 0, newHttpError(400, "Invalid Content-Length.")
+	}
+	length, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, newHttpError(400, "Invalid Content-Length.")
+	}
+	return length, nil
+}
+
+// validateHeaders applies the rules that need the whole header section
+func validateHeaders(version string, headers Http_Header) error {
+	for _, contentLength := range headers.Values("Content-Length") {
+		if _, err := parseContentLength(contentLength); err != nil {
+			return err
+		}
+	}
+	if headers.Has("Transfer-Encoding") && version == "HTTP/1.0" {
+		// HTTP/1.0 has no transfer codings, a recipient along the way may frame the
+		// body by Content-Length instead, see RFC 9112 section 6.1
+		return newHttpError(400, "Transfer-Encoding is not allowed in HTTP/1.0 requests.")
+	}
+	hosts := headers.Values("Host")
+	if len(hosts) > 1 {
+		return newHttpError(400, "Multiple Host headers.")
+	}
+	if len(hosts) == 0 && version == HTTPV {
+		return newHttpError(400, "HTTP/1.1 requests must have a Host header.")
+	}
+	return nil
+}
+
+// splitAbsoluteTarget turns an absolute-form target into the origin-form path
+// used for routing and the authority that stands in for the Host header
+func splitAbsoluteTarget(target string) (string, string, bool) {
+	if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
+		return target, "", false
+	}
+	parsed, err := url.Parse(target)
+	if err != nil || parsed.Host == "" {
+		return target, "", false
+	}
+	return parsed.RequestURI(), parsed.Host, true
+}
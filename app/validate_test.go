@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// setStrict turns strict parsing on or off for the rest of the test
+func setStrict(t *testing.T, strict bool) {
+	previous := STRICT_PARSING
+	STRICT_PARSING = strict
+	t.Cleanup(func() { STRICT_PARSING = previous })
+}
+
+// errorStatus returns the status of an Http_Error, 0 for nil and -1 for any other error
+func errorStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	var httpErr *Http_Error
+	if errors.As(err, &httpErr) {
+		return httpErr.Status
+	}
+	return -1
+}
+
+// parseRaw reads one request from raw. No body is read, so no connection is needed.
+func parseRaw(raw string) (Http_Request, error) {
+	return connStringToRequest(nil, bufio.NewReader(strings.NewReader(raw)))
+}
+
+func TestStrictRequestParsing(t *testing.T) {
+	tests := []struct {
+		name   string
+		raw    string
+		status int
+	}{
+		{"valid", "GET / HTTP/1.1\r\nHost: x\r\n\r\n", 0},
+		{"valid absolute-form", "GET http://x/a HTTP/1.1\r\nHost: x\r\n\r\n", 0},
+		{"obs-fold", "GET / HTTP/1.1\r\nHost: x\r\nX-A: a\r\n b\r\n\r\n", 400},
+		{"obs-fold with tab", "GET / HTTP/1.1\r\nHost: x\r\nX-A: a\r\n\tb\r\n\r\n", 400},
+		{"bare LF request line", "GET / HTTP/1.1\nHost: x\r\n\r\n", 400},
+		{"bare LF header", "GET / HTTP/1.1\r\nHost: x\n\r\n", 400},
+		{"bare LF end of headers", "GET / HTTP/1.1\r\nHost: x\r\n\n", 400},
+		{"space before colon", "GET / HTTP/1.1\r\nHost : x\r\n\r\n", 400},
+		{"tab before colon", "GET / HTTP/1.1\r\nHost\t: x\r\n\r\n", 400},
+		{"header without colon", "GET / HTTP/1.1\r\nHost x\r\n\r\n", 400},
+		{"control character in value", "GET / HTTP/1.1\r\nHost: x\r\nX-A: a\x00b\r\n\r\n", 400},
+		{"HTTP/2.0", "GET / HTTP/2.0\r\nHost: x\r\n\r\n", 505},
+		{"HTTP/3.0", "GET / HTTP/3.0\r\nHost: x\r\n\r\n", 505},
+		{"malformed version", "GET / HTTP/1\r\nHost: x\r\n\r\n", 400},
+		{"lowercase version", "GET / http/1.1\r\nHost: x\r\n\r\n", 400},
+		{"invalid method", "G(T / HTTP/1.1\r\nHost: x\r\n\r\n", 400},
+		{"asterisk without OPTIONS", "GET * HTTP/1.1\r\nHost: x\r\n\r\n", 400},
+		{"missing Host", "GET / HTTP/1.1\r\n\r\n", 400},
+		{"two Host headers", "GET / HTTP/1.1\r\nHost: x\r\nHost: y\r\n\r\n", 400},
+		{"Content-Length and Transfer-Encoding", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n", 400},
+		{"Content-Length list", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 5, 5\r\n\r\n", 400},
+		{"Content-Length with sign", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: +5\r\n\r\n", 400},
+		{"negative Content-Length", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: -1\r\n\r\n", 400},
+		{"Content-Length not a number", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: abc\r\n\r\n", 400},
+		{"Content-Length overflow", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 99999999999999999999\r\n\r\n", 400},
+		{"conflicting Content-Length", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\nContent-Length: 4\r\n\r\n", 400},
+		{"Transfer-Encoding in HTTP/1.0", "POST / HTTP/1.0\r\nTransfer-Encoding: chunked\r\n\r\n", 400},
+		{"Transfer-Encoding and Content-Length in HTTP/1.0", "POST / HTTP/1.0\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n", 400},
+		{"Content-Length in HTTP/1.0", "POST / HTTP/1.0\r\nContent-Length: 3\r\n\r\n", 0},
+		{"Transfer-Encoding in HTTP/1.1", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n", 0},
+		{"Transfer-Encoding not ending in chunked", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: gzip\r\n\r\n", 400},
+	}
+	setStrict(t, true)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseRaw(test.raw)
+			if status := errorStatus(err); status != test.status {
+				t.Errorf("status = %d, want %d (error: %v)", status, test.status, err)
+			}
+		})
+	}
+}
+
+func TestLenientRequestParsing(t *testing.T) {
+	tests := []struct {
+		name   string
+		raw    string
+		status int
+	}{
+		{"bare LF", "GET / HTTP/1.1\nHost: x\n\n", 0},
+		{"missing Host", "GET / HTTP/1.1\r\n\r\n", 0},
+		// Framing stays strict in both modes, two parsers must agree on where the body ends
+		{"Content-Length and Transfer-Encoding", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n", 400},
+		{"Content-Length list", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 5, 5\r\n\r\n", 400},
+		{"Content-Length with sign", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: +5\r\n\r\n", 400},
+		{"negative Content-Length", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: -1\r\n\r\n", 400},
+		{"Content-Length not a number", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: abc\r\n\r\n", 400},
+		{"Content-Length overflow", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 99999999999999999999\r\n\r\n", 400},
+	}
+	setStrict(t, false)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseRaw(test.raw)
+			if status := errorStatus(err); status != test.status {
+				t.Errorf("status = %d, want %d (error: %v)", status, test.status, err)
+			}
+		})
+	}
+}
+
+func TestParseContentLength(t *testing.T) {
+	tests := []struct {
+		value  string
+		length int64
+		valid  bool
+	}{
+		{"0", 0, true},
+		{"42", 42, true},
+		{"007", 7, true},
+		{"9223372036854775807", 9223372036854775807, true},
+		{"", 0, false},
+		{"+5", 0, false},
+		{"-1", 0, false},
+		{"5, 5", 0, false},
+		{" 5", 0, false},
+		{"5 ", 0, false},
+		{"0x10", 0, false},
+		{"9223372036854775808", 0, false},
+	}
+	for _, test := range tests {
+		length, err := parseContentLength(test.value)
+		if valid := err == nil; valid != test.valid || length != test.length {
+			t.Errorf("parseContentLength(%q) = %d, %v, want %d, valid %v", test.value, length, err, test.length, test.valid)
+		}
+	}
+}